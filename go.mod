@@ -5,6 +5,7 @@ require (
 	contrib.go.opencensus.io/exporter/stackdriver v0.7.0
 	github.com/pkg/errors v0.8.0
 	go.opencensus.io v0.18.0
+	golang.org/x/net v0.0.0-20180906233101-161cd47e91fd
 	google.golang.org/api v0.0.0-20181108001712-cfbc873f6b93
 	google.golang.org/genproto v0.0.0-20180831171423-11092d34479b
 )
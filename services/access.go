@@ -0,0 +1,126 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AccessList restricts which client addresses may reach a route. Entries
+// are CIDR ranges or single IPv4 or IPv6 addresses. A client matching
+// Deny is rejected; when Allow is set, so is any client not matching it.
+type AccessList struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// cidrList is a parsed list of address ranges.
+type cidrList []*net.IPNet
+
+func parseCIDRs(entries []string) (cidrList, error) {
+	list := make(cidrList, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address: %s", entry)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR range: %s", entry)
+		}
+		list = append(list, network)
+	}
+
+	return list, nil
+}
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessList is a compiled AccessList.
+type accessList struct {
+	allow, deny cidrList
+}
+
+// newAccessList returns nil when there is nothing to restrict.
+func newAccessList(cfg *AccessList) (*accessList, error) {
+	if cfg == nil || (len(cfg.Allow) == 0 && len(cfg.Deny) == 0) {
+		return nil, nil
+	}
+
+	allow, err := parseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid allow list")
+	}
+
+	deny, err := parseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid deny list")
+	}
+
+	return &accessList{allow: allow, deny: deny}, nil
+}
+
+// check returns an error when the client isn't allowed through.
+func (a *accessList) check(ip net.IP) error {
+	if ip == nil {
+		return errors.New("client address unknown")
+	}
+
+	if a.deny.contains(ip) {
+		return errors.Errorf("%s is denied", ip)
+	}
+
+	if len(a.allow) > 0 && !a.allow.contains(ip) {
+		return errors.Errorf("%s is not allowed", ip)
+	}
+
+	return nil
+}
+
+// clientIP returns the address of the client that made the request.
+// Connections from trusted proxies are attributed to the last address
+// in their header, as read by forwardedHops, that isn't itself a
+// trusted proxy.
+func clientIP(r *http.Request, trusted cidrList, header string) net.IP {
+	ip := remoteIP(r)
+	if ip == nil || !trusted.contains(ip) {
+		return ip
+	}
+
+	hops := forwardedHops(r.Header, header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseNode(hops[i])
+		if hop == nil {
+			// anything further left was added by an
+			// unknown party and can't be trusted.
+			break
+		}
+
+		ip = hop
+		if !trusted.contains(hop) {
+			break
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote   string
+		forwards []string
+		expected string
+	}{
+		{remote: "203.0.113.7:1234", expected: "203.0.113.7"},
+		{remote: "203.0.113.7:1234", forwards: []string{"198.51.100.1"}, expected: "203.0.113.7"},
+		{remote: "10.0.0.1:1234", expected: "10.0.0.1"},
+		{remote: "10.0.0.1:1234", forwards: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwards: []string{"1.1.1.1, 198.51.100.1, 10.0.0.2"}, expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwards: []string{"1.1.1.1", "198.51.100.1"}, expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwards: []string{"garbage, 10.0.0.2"}, expected: "10.0.0.2"},
+		{remote: "[fd00::1]:1234", forwards: []string{"2001:db8::1"}, expected: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		for _, f := range tt.forwards {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+
+		if ip := clientIP(req, trusted, ""); ip.String() != tt.expected {
+			t.Errorf("expected %s from %s %v, received %s", tt.expected, tt.remote, tt.forwards, ip)
+		}
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "open.test", Target: upstream.URL},
+		{Host: "admin.test", Target: upstream.URL, Access: &AccessList{
+			Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+			Deny:  []string{"192.0.2.13"},
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	var logs bytes.Buffer
+	h := &handler{logger: NewTextLogger(&logs)}
+	h.setTable(table)
+	h.trusted, _ = parseCIDRs([]string{"10.0.0.1"})
+	h.access, _ = newAccessList(&AccessList{Deny: []string{"198.51.100.0/24"}})
+
+	get := func(host, remote, forwarded string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		host, remote, forwarded string
+		expected                int
+	}{
+		{"open.test", "203.0.113.1:1", "", http.StatusOK},
+		{"open.test", "198.51.100.5:1", "", http.StatusForbidden},
+		{"admin.test", "192.0.2.10:1", "", http.StatusOK},
+		{"admin.test", "[2001:db8::5]:1", "", http.StatusOK},
+		{"admin.test", "192.0.2.13:1", "", http.StatusForbidden},
+		{"admin.test", "203.0.113.1:1", "", http.StatusForbidden},
+		{"admin.test", "10.0.0.1:1", "192.0.2.10", http.StatusOK},
+		{"admin.test", "10.0.0.1:1", "203.0.113.1", http.StatusForbidden},
+		{"admin.test", "203.0.113.1:1", "192.0.2.10", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if code := get(tt.host, tt.remote, tt.forwarded); code != tt.expected {
+			t.Errorf("expected %d for %s from %s (%s), received %d", tt.expected, tt.host, tt.remote, tt.forwarded, code)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "Denied by access list: 198.51.100.5 is denied") || strings.Contains(logs.String(), "Rejected client") {
+		t.Errorf("expected denials to be logged as access list denials, logged %q", logs.String())
+	}
+
+	for _, invalid := range []*AccessList{
+		{Allow: []string{"192.0.2.0/33"}},
+		{Deny: []string{"not an address"}},
+	} {
+		if _, err := newAccessList(invalid); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
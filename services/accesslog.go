@@ -0,0 +1,336 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+)
+
+// Access log formats understood by AccessLogConfig.Format. Any
+// other value is parsed as a text/template over AccessLogEntry.
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogConfig configures the access log written after
+// every request completes. When it is not set, access log
+// entries are sent to the configured Logger instead.
+type AccessLogConfig struct {
+	Format string `json:"format,omitempty"`
+	// Output is stdout (the default), stderr or the path of
+	// a file that is rotated like the file logging backend.
+	Output     string `json:"output,omitempty"`
+	MaxSizeMB  int    `json:"maxSizeMB,omitempty"`
+	MaxBackups int    `json:"maxBackups,omitempty"`
+}
+
+// AccessLogEntry describes a completed request. Its fields are
+// available to custom access log templates, e.g.
+// `{{.Method}} {{.URI}} {{.Status}} {{.Latency}}`. RemoteAddr is the
+// client's address, read from the headers of trusted proxies, and
+// PeerAddr the address of the connection when it differs.
+type AccessLogEntry struct {
+	Time            time.Time     `json:"time"`
+	RemoteAddr      string        `json:"remoteAddr"`
+	PeerAddr        string        `json:"peerAddr,omitempty"`
+	User            string        `json:"user,omitempty"`
+	Method          string        `json:"method"`
+	URI             string        `json:"uri"`
+	Proto           string        `json:"proto"`
+	Host            string        `json:"host"`
+	Status          int           `json:"status"`
+	Bytes           int64         `json:"bytes"`
+	Referer         string        `json:"referer,omitempty"`
+	UserAgent       string        `json:"userAgent,omitempty"`
+	Route           string        `json:"route,omitempty"`
+	Upstream        string        `json:"upstream,omitempty"`
+	UpstreamLatency time.Duration `json:"-"`
+	Latency         time.Duration `json:"-"`
+	TraceID         string        `json:"traceId,omitempty"`
+}
+
+// MarshalJSON reports latencies in milliseconds.
+func (e AccessLogEntry) MarshalJSON() ([]byte, error) {
+	type entry AccessLogEntry
+	return json.Marshal(struct {
+		entry
+		UpstreamLatencyMS float64 `json:"upstreamLatencyMs,omitempty"`
+		LatencyMS         float64 `json:"latencyMs"`
+	}{
+		entry:             entry(e),
+		UpstreamLatencyMS: float64(e.UpstreamLatency) / float64(time.Millisecond),
+		LatencyMS:         float64(e.Latency) / float64(time.Millisecond),
+	})
+}
+
+type accessLogger interface {
+	log(e *AccessLogEntry, r *request)
+}
+
+func newAccessLogger(cfg *AccessLogConfig, logger Logger) (accessLogger, error) {
+	if cfg == nil {
+		return &entryAccessLog{logger: logger}, nil
+	}
+
+	format, err := accessLogFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer
+	switch cfg.Output {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := newRotatingFile(cfg.Output, cfg.MaxSizeMB, cfg.MaxBackups)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open access log")
+		}
+		w = f
+	}
+
+	return &writerAccessLog{w: w, format: format}, nil
+}
+
+func accessLogFormat(name string) (func(e *AccessLogEntry) []byte, error) {
+	var format func(e *AccessLogEntry) []byte
+	switch name {
+	case "", AccessLogCombined:
+		format = formatCombined
+	case AccessLogCommon:
+		format = formatCommon
+	case AccessLogJSON:
+		format = func(e *AccessLogEntry) []byte {
+			data, _ := json.Marshal(e)
+			return append(data, '\n')
+		}
+	default:
+		tmpl, err := template.New("access").Parse(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid access log template")
+		}
+		format = func(e *AccessLogEntry) []byte {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, e); err != nil {
+				return []byte(fmt.Sprintf("access log template failed: %v\n", err))
+			}
+			if !strings.HasSuffix(b.String(), "\n") {
+				b.WriteByte('\n')
+			}
+			return []byte(b.String())
+		}
+	}
+
+	return format, nil
+}
+
+// writerAccessLog writes formatted access log lines to w.
+type writerAccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(e *AccessLogEntry) []byte
+}
+
+func (l *writerAccessLog) log(e *AccessLogEntry, r *request) {
+	line := l.format(e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w.Write(line)
+}
+
+// entryAccessLog sends access log entries to the Logger.
+type entryAccessLog struct {
+	logger Logger
+}
+
+func (l *entryAccessLog) log(e *AccessLogEntry, r *request) {
+	entry := r.entry
+	entry.Timestamp = e.Time
+	entry.Payload = "Handled HTTP Request"
+	entry.HTTPRequest = &logging.HTTPRequest{
+		Request:      r.original,
+		Status:       e.Status,
+		ResponseSize: e.Bytes,
+		Latency:      e.Latency,
+		RemoteIP:     e.RemoteAddr,
+	}
+	if e.Status >= http.StatusInternalServerError {
+		entry.Severity = logging.Error
+	}
+
+	labels := make(map[string]string, len(entry.Labels)+3)
+	for k, v := range entry.Labels {
+		labels[k] = v
+	}
+	if e.Route != "" {
+		labels["route"] = e.Route
+	}
+	if e.Upstream != "" {
+		labels["upstream"] = e.Upstream
+		labels["upstreamLatency"] = e.UpstreamLatency.String()
+	}
+	entry.Labels = labels
+
+	l.logger.Log(entry)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatCommon(e *AccessLogEntry) []byte {
+	return []byte(commonLine(e) + "\n")
+}
+
+func formatCombined(e *AccessLogEntry) []byte {
+	return []byte(fmt.Sprintf("%s %q %q\n", commonLine(e), dash(e.Referer), dash(e.UserAgent)))
+}
+
+func commonLine(e *AccessLogEntry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		dash(e.RemoteAddr),
+		dash(e.User),
+		e.Time.Format(clfTime),
+		e.Method,
+		e.URI,
+		e.Proto,
+		e.Status,
+		size,
+	)
+}
+
+// newAccessLogEntry describes the request once it has completed.
+func newAccessLogEntry(r *request) *AccessLogEntry {
+	orig := r.original
+
+	peer := orig.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+
+	remote := peer
+	if r.clientIP != nil {
+		remote = r.clientIP.String()
+	}
+	if remote == peer {
+		peer = ""
+	}
+
+	user := ""
+	if u, _, ok := orig.BasicAuth(); ok {
+		user = u
+	}
+
+	e := &AccessLogEntry{
+		Time:            r.start,
+		RemoteAddr:      remote,
+		PeerAddr:        peer,
+		User:            user,
+		Method:          orig.Method,
+		URI:             orig.URL.RequestURI(),
+		Proto:           orig.Proto,
+		Host:            orig.Host,
+		Status:          r.recorder.status,
+		Bytes:           r.recorder.bytes,
+		Referer:         orig.Referer(),
+		UserAgent:       orig.UserAgent(),
+		Route:           r.route,
+		Upstream:        r.upstream,
+		UpstreamLatency: r.upstreamLatency,
+		Latency:         time.Since(r.start),
+		TraceID:         r.span.SpanContext().TraceID.String(),
+	}
+
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+
+	return e
+}
+
+// responseRecorder captures the status and size of a response
+// while passing flushes and hijacks through to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	conns  *connTracker
+	// upgrade is set by routes for upgrade requests.
+	upgrade *upgrade
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	// informational responses are followed by the real one.
+	if rw.status == 0 && code >= 200 {
+		rw.status = code
+	}
+
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+
+	return n, err
+}
+
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil || rw.conns == nil {
+		return conn, brw, err
+	}
+
+	return rw.conns.track(conn, rw.upgrade), brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, sampleResponse)
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "butler-proxy", Path: "/api/*", Target: upstream.URL},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	format, err := accessLogFormat("{{.Status}} {{.Bytes}} {{.Route}} {{.Upstream}} {{.Method}} {{.URI}}")
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	h := &handler{
+		logger:    logger,
+		accessLog: &writerAccessLog{w: &buf, format: format},
+	}
+	h.setTable(table)
+
+	req := httptest.NewRequest(http.MethodPost, "http://butler-proxy/api/items?x=1", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	expected := fmt.Sprintf("201 %d butler-proxy/api/* %s POST /api/items?x=1\n", len(sampleResponse), host)
+	if buf.String() != expected {
+		t.Errorf("expected %q, received %q", expected, buf.String())
+	}
+}
+
+func TestAccessLogClientIP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{{Host: "butler-proxy", Target: upstream.URL}}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	format, _ := accessLogFormat("{{.RemoteAddr}} {{.PeerAddr}}")
+
+	var buf bytes.Buffer
+	h := &handler{
+		logger:    logger,
+		accessLog: &writerAccessLog{w: &buf, format: format},
+	}
+	h.trusted, _ = parseCIDRs([]string{"10.0.0.0/8"})
+	h.setTable(table)
+
+	tests := []struct {
+		remote   string
+		expected string
+	}{
+		{"10.0.0.1:1234", "198.51.100.1 10.0.0.1\n"},
+		{"203.0.113.7:1234", "203.0.113.7 \n"},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "http://butler-proxy/", nil)
+		req.RemoteAddr = tt.remote
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.expected {
+			t.Errorf("expected %q from %s, received %q", tt.expected, tt.remote, buf.String())
+		}
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &AccessLogEntry{
+		Time:       time.Date(2018, 11, 10, 13, 55, 36, 0, time.UTC),
+		RemoteAddr: "127.0.0.1",
+		User:       "frank",
+		Method:     "GET",
+		URI:        "/apache_pb.gif",
+		Proto:      "HTTP/1.0",
+		Status:     200,
+		Bytes:      2326,
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  "Mozilla/4.08",
+		Latency:    1500 * time.Microsecond,
+	}
+
+	common := `127.0.0.1 - frank [10/Nov/2018:13:55:36 +0000] "GET /apache_pb.gif HTTP/1.0" 200 2326` + "\n"
+	if line := string(formatCommon(e)); line != common {
+		t.Errorf("expected %q, received %q", common, line)
+	}
+
+	combined := strings.TrimSuffix(common, "\n") + ` "http://www.example.com/start.html" "Mozilla/4.08"` + "\n"
+	if line := string(formatCombined(e)); line != combined {
+		t.Errorf("expected %q, received %q", combined, line)
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("failed to encode entry: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	if decoded["status"] != float64(200) || decoded["latencyMs"] != 1.5 {
+		t.Errorf("unexpected JSON entry: %s", data)
+	}
+
+	if _, err := accessLogFormat("{{.Nope"); err == nil {
+		t.Error("expected invalid template to be rejected")
+	}
+}
@@ -0,0 +1,584 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+)
+
+// ACME challenge types understood by ACMEConfig.Challenge.
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+const (
+	// LetsEncryptURL is the directory used when none is configured.
+	LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	acmeALPNProto      = "acme-tls/1"
+	acmeChallengePath  = "/.well-known/acme-challenge/"
+	acmeAccountKey     = "acme_account.key"
+	acmeCheckInterval  = time.Minute
+	acmeRetryAfter     = 10 * time.Minute
+	acmeIssueTimeout   = 2 * time.Minute
+	defaultRenewBefore = 30 * 24 * time.Hour
+)
+
+// idPeACMEIdentifier is the certificate extension holding
+// the TLS-ALPN-01 key authorization, RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEConfig configures obtaining and renewing certificates
+// from an ACME certificate authority for every route host.
+type ACMEConfig struct {
+	// DirectoryURL defaults to Let's Encrypt.
+	DirectoryURL string `json:"directoryURL,omitempty"`
+	Email        string `json:"email,omitempty"`
+	// CacheDir is where the account key and certificates are stored.
+	CacheDir string `json:"cacheDir"`
+	// Challenge is http-01, answered on the plain HTTP listener,
+	// or tls-alpn-01, answered on the TLS listener.
+	Challenge   string   `json:"challenge,omitempty"`
+	RenewBefore Duration `json:"renewBefore,omitempty"`
+	// CAFile is a PEM bundle trusted when talking to the ACME server,
+	// for test servers such as Pebble.
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// Validate checks the ACME configuration.
+func (c *ACMEConfig) Validate() error {
+	if c.CacheDir == "" {
+		return errors.New("acme requires a cacheDir")
+	}
+
+	switch c.Challenge {
+	case "", ChallengeHTTP01, ChallengeTLSALPN01:
+	default:
+		return errors.Errorf("unknown ACME challenge: %s", c.Challenge)
+	}
+
+	return nil
+}
+
+// acmeManager obtains certificates on demand during the TLS handshake
+// and renews them in the background before they expire.
+type acmeManager struct {
+	cfg    ACMEConfig
+	client *acmeClient
+	hosts  func() []string
+	logger Logger
+
+	mu     sync.RWMutex
+	certs  map[string]*tls.Certificate
+	tokens map[string]string
+	alpn   map[string]*tls.Certificate
+	failed map[string]time.Time
+
+	// issuing holds a lock per host so each host is only ordered
+	// once at a time without holding up the others.
+	issuing map[string]*sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newACMEManager returns a manager issuing certificates for the
+// names returned by hosts, which is consulted on every use so
+// reloaded routes are picked up.
+func newACMEManager(cfg ACMEConfig, hosts func() []string, logger Logger) (*acmeManager, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.DirectoryURL == "" {
+		cfg.DirectoryURL = LetsEncryptURL
+	}
+	if cfg.Challenge == "" {
+		cfg.Challenge = ChallengeHTTP01
+	}
+	if cfg.RenewBefore <= 0 {
+		cfg.RenewBefore = Duration(defaultRenewBefore)
+	}
+
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create ACME cache directory")
+	}
+
+	transport := http.DefaultTransport
+	if cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ACME CA file")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+
+	key, err := loadAccountKey(filepath.Join(cfg.CacheDir, acmeAccountKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &acmeManager{
+		cfg: cfg,
+		client: &acmeClient{
+			directoryURL: cfg.DirectoryURL,
+			email:        cfg.Email,
+			key:          key,
+			client:       &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		},
+		hosts:   hosts,
+		logger:  logger,
+		certs:   map[string]*tls.Certificate{},
+		tokens:  map[string]string{},
+		alpn:    map[string]*tls.Certificate{},
+		failed:  map[string]time.Time{},
+		issuing: map[string]*sync.Mutex{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// loadAccountKey reads the account key, generating and
+// saving a new one the first time.
+func loadAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("no key found in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to read ACME account key")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, errors.Wrap(err, "failed to save ACME account key")
+	}
+
+	return key, nil
+}
+
+// writeFile replaces path atomically so a crash
+// never leaves a partially written key behind.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (m *acmeManager) allowed(host string) bool {
+	for _, h := range m.hosts() {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetCertificate serves TLS-ALPN-01 challenges and certificates for
+// route hosts. Other names return no certificate so that a statically
+// configured certificate is used instead.
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		m.mu.RLock()
+		cert := m.alpn[host]
+		m.mu.RUnlock()
+
+		if cert == nil {
+			return nil, errors.Errorf("no ACME challenge pending for %s", host)
+		}
+		return cert, nil
+	}
+
+	if host == "" || !m.allowed(host) {
+		return nil, nil
+	}
+
+	if cert := m.cached(host); cert != nil {
+		return cert, nil
+	}
+
+	return m.obtain(host)
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes
+// every other request through to next.
+func (m *acmeManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+		m.mu.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// cached returns the certificate for host from memory or disk.
+func (m *acmeManager) cached(host string) *tls.Certificate {
+	m.mu.RLock()
+	cert := m.certs[host]
+	m.mu.RUnlock()
+	if cert != nil {
+		return cert
+	}
+
+	data, err := ioutil.ReadFile(m.certPath(host))
+	if err != nil {
+		return nil
+	}
+
+	cert, err = parseKeyPair(data)
+	if err != nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	m.certs[host] = cert
+	m.mu.Unlock()
+	recordExpiry(cert)
+
+	return cert
+}
+
+func (m *acmeManager) certPath(host string) string {
+	return filepath.Join(m.cfg.CacheDir, host+".pem")
+}
+
+// parseKeyPair reads a private key followed by its certificate chain.
+func parseKeyPair(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func (m *acmeManager) needsRenewal(cert *tls.Certificate) bool {
+	return cert == nil || time.Now().Add(time.Duration(m.cfg.RenewBefore)).After(cert.Leaf.NotAfter)
+}
+
+// obtain issues a certificate for host unless another caller
+// just did or a recent attempt failed.
+func (m *acmeManager) obtain(host string) (*tls.Certificate, error) {
+	issue := m.issueLock(host)
+	issue.Lock()
+	defer issue.Unlock()
+
+	current := m.cached(host)
+	if !m.needsRenewal(current) {
+		return current, nil
+	}
+
+	m.mu.RLock()
+	failed := m.failed[host]
+	m.mu.RUnlock()
+	if time.Since(failed) < acmeRetryAfter {
+		if current != nil {
+			return current, nil
+		}
+		return nil, errors.Errorf("certificate for %s recently failed to issue", host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeIssueTimeout)
+	defer cancel()
+
+	cert, err := m.issueCertificate(ctx, host)
+	if err != nil {
+		m.mu.Lock()
+		m.failed[host] = time.Now()
+		m.mu.Unlock()
+
+		m.logger.Log(logging.Entry{
+			Timestamp: time.Now().UTC(),
+			Severity:  logging.Error,
+			Labels:    map[string]string{"host": host},
+			Payload:   "Failed to obtain certificate: " + err.Error(),
+		})
+
+		if current != nil {
+			return current, nil
+		}
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.certs[host] = cert
+	delete(m.failed, host)
+	m.mu.Unlock()
+	recordExpiry(cert)
+
+	m.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Info,
+		Labels: map[string]string{
+			"host":     host,
+			"notAfter": cert.Leaf.NotAfter.UTC().Format(time.RFC3339),
+		},
+		Payload: "Obtained certificate",
+	})
+
+	return cert, nil
+}
+
+// issueLock returns the lock serializing issuance for host. Hosts
+// are limited to those of the routes, so locks are never removed.
+func (m *acmeManager) issueLock(host string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.issuing[host]
+	if !ok {
+		l = &sync.Mutex{}
+		m.issuing[host] = l
+	}
+
+	return l
+}
+
+func (m *acmeManager) issueCertificate(ctx context.Context, host string) (*tls.Certificate, error) {
+	if err := m.client.register(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to register ACME account")
+	}
+
+	order, err := m.client.newOrder(ctx, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ACME order")
+	}
+
+	for _, url := range order.Authorizations {
+		if err := m.authorize(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+
+	// certificates use RSA keys, which every cipher suite
+	// policy can use, unlike ECDSA keys with the legacy
+	// preset's RSA key exchange or an RSA-only suite list.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create certificate request")
+	}
+
+	order, err = m.client.finalize(ctx, order, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := m.client.certificate(ctx, order.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	der := x509.MarshalPKCS1PrivateKey(key)
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), chain...)
+	cert, err := parseKeyPair(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "ACME server returned an invalid certificate")
+	}
+
+	if err := writeFile(m.certPath(host), data); err != nil {
+		return nil, errors.Wrap(err, "failed to save certificate")
+	}
+
+	return cert, nil
+}
+
+// authorize completes the configured challenge for an authorization.
+func (m *acmeManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.authorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acmeStatusValid {
+		return nil
+	}
+
+	var chal *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == m.cfg.Challenge {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return errors.Errorf("ACME server offered no %s challenge for %s", m.cfg.Challenge, authz.Identifier.Value)
+	}
+
+	host := authz.Identifier.Value
+	keyAuth := m.client.keyAuthorization(chal.Token)
+
+	switch chal.Type {
+	case ChallengeHTTP01:
+		m.mu.Lock()
+		m.tokens[chal.Token] = keyAuth
+		m.mu.Unlock()
+
+		defer func() {
+			m.mu.Lock()
+			delete(m.tokens, chal.Token)
+			m.mu.Unlock()
+		}()
+	case ChallengeTLSALPN01:
+		cert, err := alpnCertificate(host, keyAuth)
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		m.alpn[host] = cert
+		m.mu.Unlock()
+
+		defer func() {
+			m.mu.Lock()
+			delete(m.alpn, host)
+			m.mu.Unlock()
+		}()
+	}
+
+	if err := m.client.accept(ctx, chal); err != nil {
+		return err
+	}
+
+	return m.client.waitAuthorization(ctx, url)
+}
+
+// alpnCertificate returns the self-signed certificate presented
+// to the ACME server while validating TLS-ALPN-01.
+func alpnCertificate(host, keyAuth string) (*tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{host},
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeACMEIdentifier, Critical: true, Value: value},
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// start renews certificates in the background until close is called.
+// The first check waits an interval so the listeners answering
+// challenges are up.
+func (m *acmeManager) start() {
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(acmeCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.renew()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *acmeManager) close() {
+	close(m.stop)
+	<-m.done
+}
+
+// renew obtains a certificate for every host that
+// has none or whose certificate expires soon.
+func (m *acmeManager) renew() {
+	for _, host := range m.hosts() {
+		if m.needsRenewal(m.cached(host)) {
+			m.obtain(host)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is just enough of an ACME server to issue a
+// certificate after validating an HTTP-01 challenge.
+type fakeACME struct {
+	t      *testing.T
+	url    string
+	answer http.Handler
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	mu     sync.Mutex
+	jwk    map[string]string
+	valid  bool
+	cert   []byte
+	orders int
+	nonce  int
+}
+
+func newFakeACME(t *testing.T) (*fakeACME, *httptest.Server) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	f := &fakeACME{t: t, caKey: key, caCert: ca}
+	srv := httptest.NewServer(f)
+	f.url = srv.URL
+	return f, srv
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", f.nonce))
+
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(acmeDirectory{
+			NewNonce:   f.url + "/nonce",
+			NewAccount: f.url + "/account",
+			NewOrder:   f.url + "/order",
+		})
+		return
+	case "/nonce":
+		return
+	}
+
+	payload := f.verify(r)
+
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", f.url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+	case "/order":
+		f.orders++
+		w.Header().Set("Location", f.url+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f.order())
+	case "/order/1":
+		json.NewEncoder(w).Encode(f.order())
+	case "/authz/1":
+		status := acmeStatusPending
+		if f.valid {
+			status = acmeStatusValid
+		}
+		json.NewEncoder(w).Encode(acmeAuthorization{
+			Status:     status,
+			Identifier: acmeIdentifier{Type: "dns", Value: "example.test"},
+			Challenges: []acmeChallenge{
+				{Type: ChallengeHTTP01, URL: f.url + "/chal/1", Token: "token"},
+			},
+		})
+	case "/chal/1":
+		rec := httptest.NewRecorder()
+		f.answer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/.well-known/acme-challenge/token", nil))
+
+		thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, f.jwk["x"], f.jwk["y"])))
+		if expected := "token." + b64(thumbprint[:]); rec.Body.String() != expected {
+			f.t.Errorf("expected key authorization %s, received %q", expected, rec.Body.String())
+		}
+		f.valid = true
+		w.Write([]byte("{}"))
+	case "/finalize/1":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.t.Errorf("invalid CSR: %v", err)
+			return
+		}
+
+		leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}, f.caCert, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Errorf("failed to sign certificate: %v", err)
+			return
+		}
+		f.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+		json.NewEncoder(w).Encode(f.order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeACME) order() acmeOrder {
+	order := acmeOrder{
+		Status:         acmeStatusPending,
+		Authorizations: []string{f.url + "/authz/1"},
+		Finalize:       f.url + "/finalize/1",
+	}
+	if f.cert != nil {
+		order.Status = acmeStatusValid
+		order.Certificate = f.url + "/cert/1"
+	}
+	return order
+}
+
+// verify checks the JWS signature and URL and returns the payload.
+func (f *fakeACME) verify(r *http.Request) []byte {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		f.t.Errorf("invalid JWS: %v", err)
+		return nil
+	}
+
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg string
+		URL string
+		Kid string
+		JWK map[string]string
+	}
+	json.Unmarshal(header, &protected)
+
+	if protected.URL != f.url+r.URL.Path {
+		f.t.Errorf("expected JWS url %s, received %s", f.url+r.URL.Path, protected.URL)
+	}
+
+	if r.URL.Path == "/account" {
+		f.jwk = protected.JWK
+	} else if protected.Kid != f.url+"/account/1" {
+		f.t.Errorf("expected request to %s to use the account URL, received %q", r.URL.Path, protected.Kid)
+	}
+
+	x, _ := base64.RawURLEncoding.DecodeString(f.jwk["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(f.jwk["y"])
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		f.t.Errorf("invalid signature on request to %s", r.URL.Path)
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload
+}
+
+func TestACMEObtainsCertificate(t *testing.T) {
+	fake, srv := newFakeACME(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "butler-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hosts := func() []string { return []string{"example.test"} }
+	cfg := ACMEConfig{DirectoryURL: srv.URL + "/directory", CacheDir: dir}
+
+	m, err := newACMEManager(cfg, hosts, logger)
+	if err != nil {
+		t.Fatalf("failed to create ACME manager: %v", err)
+	}
+	fake.answer = m.HTTPHandler(http.NotFoundHandler())
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"})
+	if err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+	if len(cert.Leaf.DNSNames) != 1 || cert.Leaf.DNSNames[0] != "example.test" {
+		t.Errorf("unexpected certificate names: %v", cert.Leaf.DNSNames)
+	}
+
+	if cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); cert != nil || err != nil {
+		t.Errorf("expected no certificate for unknown host, received %v, %v", cert, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "example.test.pem")); err != nil {
+		t.Errorf("expected certificate to be stored: %v", err)
+	}
+
+	// a second manager finds the stored certificate and account key.
+	m, err = newACMEManager(cfg, hosts, logger)
+	if err != nil {
+		t.Fatalf("failed to create ACME manager: %v", err)
+	}
+	again, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"})
+	if err != nil {
+		t.Fatalf("failed to load certificate: %v", err)
+	}
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Error("expected certificate to be loaded from the cache")
+	}
+	if fake.orders != 1 {
+		t.Errorf("expected one order, received %d", fake.orders)
+	}
+}
+
+func TestACMEIssuesHostsIndependently(t *testing.T) {
+	fake, srv := newFakeACME(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "butler-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hosts := func() []string { return []string{"example.test", "slow.test"} }
+	m, err := newACMEManager(ACMEConfig{DirectoryURL: srv.URL + "/directory", CacheDir: dir}, hosts, logger)
+	if err != nil {
+		t.Fatalf("failed to create ACME manager: %v", err)
+	}
+	fake.answer = m.HTTPHandler(http.NotFoundHandler())
+
+	// an order for another host that hasn't completed.
+	slow := m.issueLock("slow.test")
+	slow.Lock()
+	defer slow.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.test"})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to obtain certificate: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected issuance to not wait for another host")
+	}
+}
+
+func TestACMEALPNCertificate(t *testing.T) {
+	cert, err := alpnCertificate("example.test", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	digest := sha256.Sum256([]byte("token.thumbprint"))
+	expected, _ := asn1.Marshal(digest[:])
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(idPeACMEIdentifier) {
+			if !ext.Critical || !bytes.Equal(ext.Value, expected) {
+				t.Errorf("unexpected acmeIdentifier extension: %+v", ext)
+			}
+			return
+		}
+	}
+
+	t.Error("expected acmeIdentifier extension")
+}
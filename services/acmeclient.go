@@ -0,0 +1,466 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ACME object statuses, RFC 8555 section 7.1.6.
+const (
+	acmeStatusPending    = "pending"
+	acmeStatusProcessing = "processing"
+	acmeStatusValid      = "valid"
+)
+
+// acmeClient implements the parts of RFC 8555 needed to issue a
+// certificate: account registration, orders, challenges and
+// finalization. Requests are signed with ES256.
+type acmeClient struct {
+	directoryURL string
+	email        string
+	key          *ecdsa.PrivateKey
+	client       *http.Client
+
+	mu     sync.Mutex
+	dir    *acmeDirectory
+	kid    string
+	nonces []string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeProblem is an RFC 7807 problem document returned by the server.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *acmeProblem `json:"error,omitempty"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error,omitempty"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pad returns b left padded with zeros to n bytes.
+func pad(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+
+	out := make([]byte, n)
+	copy(out[n-len(b):], b)
+	return out
+}
+
+// jwk returns the account key as a JSON web key with its members
+// in lexicographic order, as required for the thumbprint.
+func (c *acmeClient) jwk() string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64(pad(c.key.X.Bytes(), size)),
+		b64(pad(c.key.Y.Bytes(), size)),
+	)
+}
+
+// keyAuthorization returns the response to a challenge token.
+func (c *acmeClient) keyAuthorization(token string) string {
+	thumbprint := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(thumbprint[:])
+}
+
+func (c *acmeClient) directory(ctx context.Context) (*acmeDirectory, error) {
+	c.mu.Lock()
+	dir := c.dir
+	c.mu.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch ACME directory")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch ACME directory: %s", res.Status)
+	}
+
+	dir = &acmeDirectory{}
+	if err := json.NewDecoder(res.Body).Decode(dir); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ACME directory")
+	}
+
+	c.mu.Lock()
+	c.dir = dir
+	c.mu.Unlock()
+
+	return dir, nil
+}
+
+func (c *acmeClient) nonce(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mu.Unlock()
+		return nonce, nil
+	}
+	c.mu.Unlock()
+
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to fetch ACME nonce")
+	}
+	res.Body.Close()
+
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("ACME server returned no nonce")
+	}
+
+	return nonce, nil
+}
+
+func (c *acmeClient) saveNonce(res *http.Response) {
+	if nonce := res.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mu.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mu.Unlock()
+	}
+}
+
+// sign wraps payload in a flattened JWS. The account key is embedded
+// until the account has been registered and referred to by URL after.
+func (c *acmeClient) sign(url, nonce string, payload []byte) ([]byte, error) {
+	c.mu.Lock()
+	kid := c.kid
+	c.mu.Unlock()
+
+	protected := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, nonce, url)
+	if kid != "" {
+		protected += fmt.Sprintf(`"kid":%q}`, kid)
+	} else {
+		protected += `"jwk":` + c.jwk() + `}`
+	}
+
+	input := b64([]byte(protected)) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sig := append(pad(r.Bytes(), 32), pad(s.Bytes(), 32)...)
+	return json.Marshal(map[string]string{
+		"protected": b64([]byte(protected)),
+		"payload":   b64(payload),
+		"signature": b64(sig),
+	})
+}
+
+// post sends a signed request. A nil payload is sent as a
+// POST-as-GET. Error responses are returned as *acmeProblem.
+func (c *acmeClient) post(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// a stale nonce is retried once with the fresh
+	// nonce the server sent alongside the error.
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		jws, err := c.sign(url, nonce, body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to sign ACME request")
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jws))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		req.Header.Set("User-Agent", "butler")
+
+		res, err := c.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		c.saveNonce(res)
+
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+
+		problem := &acmeProblem{Status: res.StatusCode}
+		data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+		res.Body.Close()
+		if err := json.Unmarshal(data, problem); err != nil || problem.Type == "" {
+			return nil, errors.Errorf("ACME server responded with %s", res.Status)
+		}
+
+		if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+			continue
+		}
+
+		return nil, problem
+	}
+}
+
+// fetch sends a POST-as-GET and decodes the response into v.
+func (c *acmeClient) fetch(ctx context.Context, url string, v interface{}) (*http.Response, error) {
+	res, err := c.post(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return res, json.NewDecoder(res.Body).Decode(v)
+}
+
+// register creates the account, or finds the existing
+// account for the key, the first time it is called.
+func (c *acmeClient) register(ctx context.Context) error {
+	c.mu.Lock()
+	kid := c.kid
+	c.mu.Unlock()
+	if kid != "" {
+		return nil
+	}
+
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return err
+	}
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.email != "" {
+		account["contact"] = []string{"mailto:" + c.email}
+	}
+
+	res, err := c.post(ctx, dir.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.Header.Get("Location") == "" {
+		return errors.New("ACME server returned no account URL")
+	}
+
+	c.mu.Lock()
+	c.kid = res.Header.Get("Location")
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *acmeClient) newOrder(ctx context.Context, hosts ...string) (*acmeOrder, error) {
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]acmeIdentifier, len(hosts))
+	for i, host := range hosts {
+		ids[i] = acmeIdentifier{Type: "dns", Value: host}
+	}
+
+	res, err := c.post(ctx, dir.NewOrder, map[string]interface{}{"identifiers": ids})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	order := &acmeOrder{URL: res.Header.Get("Location")}
+	if err := json.NewDecoder(res.Body).Decode(order); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ACME order")
+	}
+
+	return order, nil
+}
+
+func (c *acmeClient) authorization(ctx context.Context, url string) (*acmeAuthorization, error) {
+	authz := &acmeAuthorization{}
+	if _, err := c.fetch(ctx, url, authz); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch ACME authorization")
+	}
+
+	return authz, nil
+}
+
+// accept tells the server the challenge is ready to be validated.
+func (c *acmeClient) accept(ctx context.Context, chal *acmeChallenge) error {
+	res, err := c.post(ctx, chal.URL, struct{}{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to accept %s challenge", chal.Type)
+	}
+
+	return res.Body.Close()
+}
+
+// waitAuthorization polls an authorization until it is no longer pending.
+func (c *acmeClient) waitAuthorization(ctx context.Context, url string) error {
+	for {
+		authz := &acmeAuthorization{}
+		res, err := c.fetch(ctx, url, authz)
+		if err != nil {
+			return errors.Wrap(err, "failed to poll ACME authorization")
+		}
+
+		switch authz.Status {
+		case acmeStatusValid:
+			return nil
+		case acmeStatusPending, acmeStatusProcessing:
+		default:
+			for _, chal := range authz.Challenges {
+				if chal.Error != nil {
+					return errors.Wrapf(chal.Error, "%s challenge for %s failed", chal.Type, authz.Identifier.Value)
+				}
+			}
+			return errors.Errorf("authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+
+		if err := sleep(ctx, retryAfter(res)); err != nil {
+			return err
+		}
+	}
+}
+
+// finalize submits the CSR and polls the order until
+// the certificate has been issued.
+func (c *acmeClient) finalize(ctx context.Context, order *acmeOrder, csr []byte) (*acmeOrder, error) {
+	res, err := c.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to finalize ACME order")
+	}
+	res.Body.Close()
+
+	for {
+		next := &acmeOrder{URL: order.URL}
+		res, err := c.fetch(ctx, order.URL, next)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to poll ACME order")
+		}
+
+		switch next.Status {
+		case acmeStatusValid:
+			return next, nil
+		case acmeStatusPending, acmeStatusProcessing, "ready":
+		default:
+			if next.Error != nil {
+				return nil, next.Error
+			}
+			return nil, errors.Errorf("order is %s", next.Status)
+		}
+
+		if err := sleep(ctx, retryAfter(res)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// certificate downloads the PEM encoded certificate chain.
+func (c *acmeClient) certificate(ctx context.Context, url string) ([]byte, error) {
+	res, err := c.post(ctx, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download certificate")
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+func retryAfter(res *http.Response) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(res.Header.Get("Retry-After"))); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	return time.Second
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,557 @@
+package services
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+)
+
+// Upstream states that can be set through the admin API. Draining and
+// disabled upstreams receive no new requests; disabled ones are not
+// health checked either.
+const (
+	UpstreamEnabled  = "enabled"
+	UpstreamDraining = "draining"
+	UpstreamDisabled = "disabled"
+)
+
+var upstreamStates = []string{UpstreamEnabled, UpstreamDraining, UpstreamDisabled}
+
+// AdminConfig enables the admin API on its own listener. Requests must
+// carry Token as a bearer token, a client certificate signed by
+// ClientCA, or both when both are set.
+type AdminConfig struct {
+	ListenAddress string `json:"listenAddress"`
+	Token         string `json:"token,omitempty"`
+
+	// CertFile and KeyFile serve the API over TLS,
+	// which ClientCA requires.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	ClientCA string `json:"clientCA,omitempty"`
+}
+
+// Validate checks that the admin API is bound and protected.
+func (c *AdminConfig) Validate() error {
+	if c.ListenAddress == "" {
+		return errors.New("admin listenAddress is required")
+	}
+
+	if c.Token == "" && c.ClientCA == "" {
+		return errors.New("admin API requires a token or a clientCA")
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("admin certFile and keyFile must be set together")
+	}
+
+	if c.ClientCA != "" && c.CertFile == "" {
+		return errors.New("admin clientCA requires a certFile and keyFile")
+	}
+
+	return nil
+}
+
+// State returns the admin state of the backend.
+func (b *Backend) State() string {
+	return upstreamStates[atomic.LoadInt32(&b.state)]
+}
+
+func (b *Backend) setState(state string) {
+	for i, s := range upstreamStates {
+		if s == state {
+			atomic.StoreInt32(&b.state, int32(i))
+			return
+		}
+	}
+}
+
+// runtimeState holds the changes made through the admin API. They are
+// layered over the routes from the configuration file and survive its
+// reloads, but not a restart.
+type runtimeState struct {
+	mu sync.Mutex
+	// base is the configuration the process started with and
+	// targets the routes most recently read from it.
+	base    *Config
+	targets Routes
+	// routes replaces configured routes by key, a nil
+	// route removes one.
+	routes map[string]*Route
+	// upstreams holds upstream states by route key and URL.
+	upstreams map[string]map[string]string
+}
+
+// merged returns the configured routes with the runtime changes applied.
+func (s *runtimeState) merged() Routes {
+	var routes Routes
+	seen := map[string]bool{}
+	for _, r := range s.targets {
+		key := r.key()
+		seen[key] = true
+
+		override, ok := s.routes[key]
+		switch {
+		case !ok:
+			routes = append(routes, r)
+		case override != nil:
+			routes = append(routes, *override)
+		}
+	}
+
+	var added []string
+	for key, r := range s.routes {
+		if r != nil && !seen[key] {
+			added = append(added, key)
+		}
+	}
+
+	sort.Strings(added)
+	for _, key := range added {
+		routes = append(routes, *s.routes[key])
+	}
+
+	return routes
+}
+
+// rebuild compiles the merged routes and swaps in the resulting
+// table. Callers hold h.runtime.mu.
+func (h *handler) rebuild() ([]string, error) {
+	table, err := newRouteTable(h.runtime.merged(), h.table())
+	if err != nil {
+		return nil, err
+	}
+
+	if h.certs != nil {
+		if err := h.certs.check(table); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, states := range h.runtime.upstreams {
+		r, ok := table.keys[key]
+		if !ok {
+			continue
+		}
+
+		for _, b := range r.backends {
+			if state, ok := states[b.URL.String()]; ok {
+				b.setState(state)
+			}
+		}
+	}
+
+	return h.setTable(table), nil
+}
+
+// routeStatus describes a route in the admin API.
+type routeStatus struct {
+	Key       string           `json:"key"`
+	Source    string           `json:"source"`
+	Route     Route            `json:"route"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+// upstreamStatus describes, and through PUT /upstreams
+// changes, the state of one of a route's upstreams.
+type upstreamStatus struct {
+	Route       string `json:"route"`
+	URL         string `json:"url"`
+	Weight      int    `json:"weight,omitempty"`
+	Healthy     bool   `json:"healthy"`
+	State       string `json:"state"`
+	Outstanding int64  `json:"outstanding"`
+	Circuit     string `json:"circuit,omitempty"`
+	Ejected     bool   `json:"ejected,omitempty"`
+}
+
+type adminHandler struct {
+	h     *handler
+	token string
+}
+
+// newAdminServer returns the server for the admin API.
+func newAdminServer(cfg *AdminConfig, h *handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: &adminHandler{h: h, token: cfg.Token},
+	}
+
+	if cfg.ClientCA != "" {
+		data, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read admin client CA")
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.ClientCA)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  roots,
+		}
+	}
+
+	return srv, nil
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+	}
+
+	switch {
+	case r.URL.Path == "/config" && r.Method == http.MethodGet:
+		a.config(w)
+	case r.URL.Path == "/routes" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.routes(""))
+	case r.URL.Path == "/routes" && r.Method == http.MethodPost:
+		a.putRoute(w, r, "")
+	case strings.HasPrefix(r.URL.Path, "/routes/"):
+		key := strings.TrimPrefix(r.URL.Path, "/routes/")
+		switch r.Method {
+		case http.MethodGet:
+			routes := a.routes(key)
+			if len(routes) == 0 {
+				writeJSON(w, http.StatusNotFound, errors.Errorf("no route %s", key))
+				return
+			}
+			writeJSON(w, http.StatusOK, routes[0])
+		case http.MethodPut:
+			a.putRoute(w, r, key)
+		case http.MethodDelete:
+			a.deleteRoute(w, r, key)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, errors.Errorf("%s not allowed", r.Method))
+		}
+	case r.URL.Path == "/upstreams" && r.Method == http.MethodGet:
+		var upstreams []upstreamStatus
+		for _, route := range a.routes("") {
+			upstreams = append(upstreams, route.Upstreams...)
+		}
+		writeJSON(w, http.StatusOK, upstreams)
+	case r.URL.Path == "/upstreams" && r.Method == http.MethodPut:
+		a.putUpstream(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, errors.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// routes returns the status of the route with key, or
+// of every route when key is empty.
+func (a *adminHandler) routes(key string) []routeStatus {
+	a.h.runtime.mu.Lock()
+	overrides := a.h.runtime.routes
+	a.h.runtime.mu.Unlock()
+
+	table := a.h.table()
+	keys := table.sortedKeys()
+	if key != "" {
+		keys = []string{key}
+	}
+
+	statuses := []routeStatus{}
+	for _, key := range keys {
+		r, ok := table.keys[key]
+		if !ok {
+			continue
+		}
+
+		source := "file"
+		if _, ok := overrides[key]; ok {
+			source = "admin"
+		}
+
+		status := routeStatus{Key: key, Source: source, Route: redactRoute(r.Route), Upstreams: []upstreamStatus{}}
+		for _, b := range r.backends {
+			upstream := upstreamStatus{
+				Route:       key,
+				URL:         redactURL(b.URL.String()),
+				Weight:      b.Weight,
+				Healthy:     b.Healthy(),
+				State:       b.State(),
+				Outstanding: b.Outstanding(),
+			}
+			if b.circuit != nil {
+				upstream.Circuit = b.circuit.State()
+			}
+			if r.outlier != nil {
+				upstream.Ejected = time.Now().Before(r.outlier.ejectedUntil(b))
+			}
+			status.Upstreams = append(status.Upstreams, upstream)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// putRoute adds a route or, given the key of an existing one, replaces it.
+func (a *adminHandler) putRoute(w http.ResponseWriter, r *http.Request, key string) {
+	var route Route
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		writeJSON(w, http.StatusBadRequest, errors.Wrap(err, "invalid route"))
+		return
+	}
+
+	if key != "" && route.key() != key {
+		writeJSON(w, http.StatusBadRequest, errors.Errorf("route %s doesn't match %s", route.key(), key))
+		return
+	}
+
+	if key == "" {
+		if _, ok := a.h.table().keys[route.key()]; ok {
+			writeJSON(w, http.StatusConflict, errors.Errorf("route %s already exists", route.key()))
+			return
+		}
+	}
+
+	a.change(w, r, route.key(), &route, "Admin updated route")
+}
+
+func (a *adminHandler) deleteRoute(w http.ResponseWriter, r *http.Request, key string) {
+	if _, ok := a.h.table().keys[key]; !ok {
+		writeJSON(w, http.StatusNotFound, errors.Errorf("no route %s", key))
+		return
+	}
+
+	a.change(w, r, key, nil, "Admin removed route")
+}
+
+// change records a runtime change to the route with key and rebuilds
+// the route table, undoing the change if the table is invalid.
+func (a *adminHandler) change(w http.ResponseWriter, r *http.Request, key string, route *Route, msg string) {
+	s := &a.h.runtime
+	s.mu.Lock()
+	prev := s.routes
+	s.routes = map[string]*Route{}
+	for k, v := range prev {
+		s.routes[k] = v
+	}
+	s.routes[key] = route
+
+	_, err := a.h.rebuild()
+	if err != nil {
+		s.routes = prev
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, err)
+		return
+	}
+
+	a.h.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Notice,
+		Labels: map[string]string{
+			"route":  key,
+			"remote": r.RemoteAddr,
+		},
+		Payload: msg,
+	})
+
+	if route == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.routes(key)[0])
+}
+
+// putUpstream sets the state of one of a route's upstreams.
+func (a *adminHandler) putUpstream(w http.ResponseWriter, r *http.Request) {
+	var req upstreamStatus
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errors.Wrap(err, "invalid upstream"))
+		return
+	}
+
+	valid := false
+	for _, s := range upstreamStates {
+		valid = valid || s == req.State
+	}
+	if !valid {
+		writeJSON(w, http.StatusBadRequest, errors.Errorf("unknown upstream state: %s", req.State))
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errors.Wrap(err, "invalid upstream URL"))
+		return
+	}
+
+	s := &a.h.runtime
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	route, ok := a.h.table().keys[req.Route]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errors.Errorf("no route %s", req.Route))
+		return
+	}
+
+	// upstreams are listed with their passwords redacted,
+	// so either form of the URL names the upstream.
+	var backend *Backend
+	for _, b := range route.backends {
+		if b.URL.String() == u.String() || redactURL(b.URL.String()) == u.String() {
+			backend = b
+		}
+	}
+	if backend == nil {
+		writeJSON(w, http.StatusNotFound, errors.Errorf("route %s has no upstream %s", req.Route, req.URL))
+		return
+	}
+
+	if s.upstreams == nil {
+		s.upstreams = map[string]map[string]string{}
+	}
+	if s.upstreams[req.Route] == nil {
+		s.upstreams[req.Route] = map[string]string{}
+	}
+	s.upstreams[req.Route][backend.URL.String()] = req.State
+	backend.setState(req.State)
+
+	a.h.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Notice,
+		Labels: map[string]string{
+			"route":    req.Route,
+			"upstream": redactURL(backend.URL.String()),
+			"state":    req.State,
+			"remote":   r.RemoteAddr,
+		},
+		Payload: "Admin changed upstream state",
+	})
+
+	writeJSON(w, http.StatusOK, upstreamStatus{
+		Route:       req.Route,
+		URL:         redactURL(backend.URL.String()),
+		Weight:      backend.Weight,
+		Healthy:     backend.Healthy(),
+		State:       backend.State(),
+		Outstanding: backend.Outstanding(),
+	})
+}
+
+// config returns the configuration in effect: the one the process
+// started with, with the current routes and secrets left out.
+func (a *adminHandler) config(w http.ResponseWriter) {
+	s := &a.h.runtime
+	s.mu.Lock()
+	cfg := Config{}
+	if s.base != nil {
+		cfg = *s.base
+	}
+	cfg.Targets = s.merged()
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, redactConfig(cfg))
+}
+
+// redacted replaces secret values shown by the admin API.
+const redacted = "REDACTED"
+
+// redactConfig returns a copy of cfg without private keys, tokens,
+// exporter headers or passwords in upstream URLs. Only the copy is
+// changed, as its nested values are copied before they're cleared.
+func redactConfig(cfg Config) Config {
+	if cfg.TLS != nil {
+		t := *cfg.TLS
+		t.KeyBlock = nil
+		t.Certificates = make([]KeyPair, len(cfg.TLS.Certificates))
+		for i, pair := range cfg.TLS.Certificates {
+			pair.KeyBlock = nil
+			t.Certificates[i] = pair
+		}
+		cfg.TLS = &t
+	}
+
+	if cfg.Admin != nil {
+		admin := *cfg.Admin
+		admin.Token = ""
+		cfg.Admin = &admin
+	}
+
+	if cfg.Tracing != nil && cfg.Tracing.OTLP != nil {
+		tracing := *cfg.Tracing
+		otlp := *cfg.Tracing.OTLP
+		otlp.Headers = make(map[string]string, len(cfg.Tracing.OTLP.Headers))
+		for k := range cfg.Tracing.OTLP.Headers {
+			otlp.Headers[k] = redacted
+		}
+		tracing.OTLP = &otlp
+		cfg.Tracing = &tracing
+	}
+
+	targets := make(Routes, len(cfg.Targets))
+	for i, r := range cfg.Targets {
+		targets[i] = redactRoute(r)
+	}
+	cfg.Targets = targets
+
+	return cfg
+}
+
+// redactRoute returns a copy of r without passwords in its upstream URLs.
+func redactRoute(r Route) Route {
+	r.Target = redactURL(r.Target)
+	if r.Upstreams != nil {
+		upstreams := make([]Upstream, len(r.Upstreams))
+		for i, u := range r.Upstreams {
+			u.URL = redactURL(u.URL)
+			upstreams[i] = u
+		}
+		r.Upstreams = upstreams
+	}
+
+	return r
+}
+
+// redactURL hides the password of a URL, if it has one.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+
+	return u.String()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = map[string]string{"error": err.Error()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Balancer names understood by BalancerConfig.Type.
+const (
+	RoundRobin       = "round_robin"
+	WeightedRandom   = "weighted_random"
+	LeastOutstanding = "least_outstanding"
+	PowerOfTwo       = "p2c"
+	ConsistentHash   = "consistent_hash"
+)
+
+// Upstream is a single server behind a route.
+type Upstream struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// BalancerConfig selects how a route spreads requests over its
+// upstreams. The consistent_hash balancer hashes on Header or Cookie
+// when set and on the client IP otherwise.
+type BalancerConfig struct {
+	Type   string `json:"type,omitempty"`
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+}
+
+// Backend is the runtime state of an Upstream.
+type Backend struct {
+	URL         *url.URL
+	Weight      int
+	outstanding int64
+	unhealthy   int32
+	state       int32
+	circuit     *circuitBreaker
+}
+
+// Outstanding returns the number of requests currently being
+// served by the backend.
+func (b *Backend) Outstanding() int64 {
+	return atomic.LoadInt64(&b.outstanding)
+}
+
+// reserve counts a request against the backend unless it already
+// has limit requests outstanding. Zero means no limit.
+func (b *Backend) reserve(limit int64) bool {
+	for {
+		n := atomic.LoadInt64(&b.outstanding)
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.outstanding, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release gives back a request counted by reserve.
+func (b *Backend) release() {
+	atomic.AddInt64(&b.outstanding, -1)
+}
+
+// Balancer picks the backend a request should be sent to. Backends
+// that are not able to take traffic have already been filtered out
+// and the slice is never empty.
+type Balancer interface {
+	Pick(r *http.Request, backends []*Backend) *Backend
+}
+
+// BalancerFactory creates a Balancer for a route.
+type BalancerFactory func(cfg BalancerConfig) (Balancer, error)
+
+var (
+	balancersMu sync.RWMutex
+	balancers   = map[string]BalancerFactory{
+		RoundRobin: func(BalancerConfig) (Balancer, error) {
+			return &roundRobin{current: map[*Backend]int{}}, nil
+		},
+		WeightedRandom: func(BalancerConfig) (Balancer, error) {
+			return weightedRandom{}, nil
+		},
+		LeastOutstanding: func(BalancerConfig) (Balancer, error) {
+			return leastOutstanding{}, nil
+		},
+		PowerOfTwo: func(BalancerConfig) (Balancer, error) {
+			return powerOfTwo{}, nil
+		},
+		ConsistentHash: func(cfg BalancerConfig) (Balancer, error) {
+			if cfg.Header != "" && cfg.Cookie != "" {
+				return nil, errors.New("consistent_hash accepts either a header or a cookie, not both")
+			}
+			return consistentHash{header: cfg.Header, cookie: cfg.Cookie}, nil
+		},
+	}
+)
+
+// RegisterBalancer makes a balancer available to routes under name,
+// replacing any balancer already registered with that name.
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	balancers[name] = factory
+}
+
+func newBalancer(cfg *BalancerConfig) (Balancer, error) {
+	if cfg == nil {
+		cfg = &BalancerConfig{}
+	}
+
+	name := cfg.Type
+	if name == "" {
+		name = RoundRobin
+	}
+
+	balancersMu.RLock()
+	factory, ok := balancers[name]
+	balancersMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown balancer: %s", name)
+	}
+
+	return factory(*cfg)
+}
+
+// roundRobin is a smooth weighted round robin: every pick adds each
+// backend's weight to its counter and the highest counter wins and
+// is reduced by the total weight.
+type roundRobin struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (rr *roundRobin) Pick(r *http.Request, backends []*Backend) *Backend {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		rr.current[b] += b.Weight
+		total += b.Weight
+		if best == nil || rr.current[b] > rr.current[best] {
+			best = b
+		}
+	}
+
+	rr.current[best] -= total
+
+	return best
+}
+
+type weightedRandom struct{}
+
+func (weightedRandom) Pick(r *http.Request, backends []*Backend) *Backend {
+	total := 0
+	for _, b := range backends {
+		total += b.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, b := range backends {
+		if n < b.Weight {
+			return b
+		}
+		n -= b.Weight
+	}
+
+	return backends[len(backends)-1]
+}
+
+// load is the number of outstanding requests relative to weight.
+func load(b *Backend) float64 {
+	return float64(b.Outstanding()+1) / float64(b.Weight)
+}
+
+type leastOutstanding struct{}
+
+func (leastOutstanding) Pick(r *http.Request, backends []*Backend) *Backend {
+	// start at a random offset so ties don't all land on the first backend.
+	offset := rand.Intn(len(backends))
+	best := backends[offset]
+	for i := 1; i < len(backends); i++ {
+		b := backends[(offset+i)%len(backends)]
+		if load(b) < load(best) {
+			best = b
+		}
+	}
+
+	return best
+}
+
+// powerOfTwo picks two backends at random and keeps the less loaded one.
+type powerOfTwo struct{}
+
+func (powerOfTwo) Pick(r *http.Request, backends []*Backend) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+
+	if load(backends[j]) < load(backends[i]) {
+		return backends[j]
+	}
+
+	return backends[i]
+}
+
+// consistentHash uses weighted rendezvous hashing so a key keeps
+// mapping to the same backend while it is available, and only the
+// keys of a removed backend move when the set changes.
+type consistentHash struct {
+	header string
+	cookie string
+}
+
+func (c consistentHash) key(r *http.Request) string {
+	switch {
+	case c.header != "":
+		return r.Header.Get(c.header)
+	case c.cookie != "":
+		if cookie, err := r.Cookie(c.cookie); err == nil {
+			return cookie.Value
+		}
+		return ""
+	default:
+		// behind trusted proxies every request comes from a proxy,
+		// so hash on the client address the handler derived.
+		if state := requestFrom(r.Context()); state != nil && state.clientIP != nil {
+			return state.clientIP.String()
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+func (c consistentHash) Pick(r *http.Request, backends []*Backend) *Backend {
+	key := c.key(r)
+
+	var best *Backend
+	bestScore := math.Inf(-1)
+	for _, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(b.URL.String()))
+
+		// map the hash into (0, 1) and weight it.
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(b.Weight) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+
+	return best
+}
+
+func newBackends(route Route) ([]*Backend, error) {
+	upstreams := route.Upstreams
+	if route.Target != "" {
+		upstreams = append([]Upstream{{URL: route.Target}}, upstreams...)
+	}
+
+	if len(upstreams) == 0 {
+		return nil, errors.Errorf("route %s has no target or upstreams", route.key())
+	}
+
+	backends := make([]*Backend, 0, len(upstreams))
+	for _, u := range upstreams {
+		remote, err := url.Parse(u.URL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid upstream for %s", route.key())
+		}
+
+		if remote.Scheme != "http" && remote.Scheme != "https" {
+			return nil, errors.Errorf("upstream for %s must be an http or https URL: %s", route.key(), u.URL)
+		}
+
+		if remote.Host == "" {
+			return nil, errors.Errorf("upstream for %s is missing a host: %s", route.key(), u.URL)
+		}
+
+		if u.Weight < 0 {
+			return nil, errors.Errorf("upstream weight for %s must not be negative: %s", route.key(), u.URL)
+		}
+
+		weight := u.Weight
+		if weight == 0 {
+			weight = 1
+		}
+
+		backends = append(backends, &Backend{URL: remote, Weight: weight})
+	}
+
+	return backends, nil
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testBackends(weights ...int) []*Backend {
+	backends := make([]*Backend, len(weights))
+	for i, w := range weights {
+		backends[i] = &Backend{
+			URL:    &url.URL{Scheme: "http", Host: fmt.Sprintf("backend-%d", i)},
+			Weight: w,
+		}
+	}
+
+	return backends
+}
+
+func TestRoundRobin(t *testing.T) {
+	b, err := newBalancer(nil)
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	backends := testBackends(3, 1)
+	counts := map[*Backend]int{}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 8; i++ {
+		counts[b.Pick(req, backends)]++
+	}
+
+	if counts[backends[0]] != 6 || counts[backends[1]] != 2 {
+		t.Errorf("expected a 6/2 split, received %d/%d", counts[backends[0]], counts[backends[1]])
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	backends[0].outstanding = 4
+	backends[2].outstanding = 2
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 10; i++ {
+		if b := (leastOutstanding{}).Pick(req, backends); b != backends[1] {
+			t.Fatalf("expected the idle backend, received %s", b.URL.Host)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	b, err := newBalancer(&BalancerConfig{Type: ConsistentHash, Header: "X-User"})
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	backends := testBackends(1, 1, 1, 1)
+	picks := map[string]*Backend{}
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		picks[req.Header.Get("X-User")] = b.Pick(req, backends)
+	}
+
+	// dropping a backend must only move the keys that were on it.
+	remaining := backends[1:]
+	for user, prev := range picks {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", user)
+		next := b.Pick(req, remaining)
+		if prev != backends[0] && next != prev {
+			t.Errorf("expected %s to stay on %s, moved to %s", user, prev.URL.Host, next.URL.Host)
+		}
+	}
+}
+
+type firstBalancer struct{}
+
+func (firstBalancer) Pick(r *http.Request, backends []*Backend) *Backend {
+	return backends[0]
+}
+
+func TestRouteUpstreams(t *testing.T) {
+	var servers []*httptest.Server
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("upstream-%d", i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name+r.URL.Path)
+		}))
+		defer srv.Close()
+		servers = append(servers, srv)
+	}
+
+	RegisterBalancer("first", func(BalancerConfig) (Balancer, error) {
+		return firstBalancer{}, nil
+	})
+
+	r, err := compileRoute(Route{
+		Host: "butler-proxy",
+		Upstreams: []Upstream{
+			{URL: servers[0].URL + "/base"},
+			{URL: servers[1].URL},
+		},
+		Balancer: &BalancerConfig{Type: "first"},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile route: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		r.proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hello", nil))
+		if body := rec.Body.String(); body != "upstream-0/base/hello" {
+			t.Errorf("expected upstream-0/base/hello, received %q", body)
+		}
+	}
+
+	if n := r.backends[0].Outstanding(); n != 0 {
+		t.Errorf("expected no outstanding requests, received %d", n)
+	}
+
+	if _, err := compileRoute(Route{Host: "a", Target: "http://a", Balancer: &BalancerConfig{Type: "nope"}}); err == nil {
+		t.Error("expected unknown balancer to be rejected")
+	}
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+)
+
+// RouteTLS marks a route as served over TLS, optionally
+// with its own certificate for the route's host.
+type RouteTLS struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	// ClientCA is a PEM bundle that client certificates must chain
+	// to. Requests without a valid client certificate are rejected.
+	ClientCA string `json:"clientCA,omitempty"`
+	// AllowedSubjects limits the client certificates accepted to
+	// those whose common name or a SAN matches one of the patterns,
+	// where "*" matches any run of characters.
+	AllowedSubjects []string `json:"allowedSubjects,omitempty"`
+	// ForwardClientCert passes the verified certificate's subject,
+	// SANs and SHA-256 fingerprint to the upstream in headers.
+	ForwardClientCert bool `json:"forwardClientCert,omitempty"`
+}
+
+// KeyPair is a certificate and key served for the names it covers.
+type KeyPair struct {
+	CertFile  string `json:"cert_file,omitempty"`
+	KeyFile   string `json:"key_file,omitempty"`
+	CertBlock []byte `json:"cert_block,omitempty"`
+	KeyBlock  []byte `json:"key_block,omitempty"`
+}
+
+func (p KeyPair) empty() bool {
+	return p.CertFile == "" && p.KeyFile == "" && p.CertBlock == nil && p.KeyBlock == nil
+}
+
+// load reads the key pair and parses its leaf certificate.
+func (p KeyPair) load() (*tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case p.CertBlock != nil && p.KeyBlock != nil:
+		cert, err = tls.X509KeyPair(p.CertBlock, p.KeyBlock)
+	case p.CertFile != "" && p.KeyFile != "":
+		cert, err = tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	default:
+		return nil, errors.New("a certificate requires both a certificate and a key")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// certFile is a key pair that is read again when its files change.
+// The current certificate is swapped atomically, so handshakes
+// never see a partially loaded pair.
+type certFile struct {
+	pair     KeyPair
+	cert     atomic.Value
+	certStat os.FileInfo
+	keyStat  os.FileInfo
+}
+
+func loadCertFile(pair KeyPair) (*certFile, error) {
+	f := &certFile{
+		pair:     pair,
+		certStat: stat(pair.CertFile),
+		keyStat:  stat(pair.KeyFile),
+	}
+
+	cert, err := pair.load()
+	if err != nil {
+		return nil, err
+	}
+	f.cert.Store(cert)
+	recordExpiry(cert)
+
+	return f, nil
+}
+
+func (f *certFile) get() *tls.Certificate {
+	return f.cert.Load().(*tls.Certificate)
+}
+
+// reload reads the key pair again if either file changed since it
+// was last read and returns the new certificate. The current
+// certificate is kept if the new pair is invalid.
+func (f *certFile) reload() (*tls.Certificate, error) {
+	if f.pair.CertFile == "" {
+		return nil, nil
+	}
+
+	certStat, keyStat := stat(f.pair.CertFile), stat(f.pair.KeyFile)
+	if sameFile(certStat, f.certStat) && sameFile(keyStat, f.keyStat) {
+		return nil, nil
+	}
+	f.certStat, f.keyStat = certStat, keyStat
+
+	cert, err := f.pair.load()
+	if err != nil {
+		return nil, err
+	}
+	f.cert.Store(cert)
+	recordExpiry(cert)
+
+	return cert, nil
+}
+
+// recordExpiry records when the certificate expires, by its first name.
+func recordExpiry(cert *tls.Certificate) {
+	name := cert.Leaf.Subject.CommonName
+	if names := certNames(cert); len(names) > 0 {
+		name = names[0]
+	}
+
+	record(context.Background(), []tag.Mutator{
+		tag.Upsert(keyCert, name),
+	}, certExpiry.M(float64(cert.Leaf.NotAfter.Unix())))
+}
+
+// hostname returns a route host without its port, in lower case.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(host)
+}
+
+// certNames returns the names a certificate is served for.
+func certNames(cert *tls.Certificate) []string {
+	if len(cert.Leaf.DNSNames) == 0 && cert.Leaf.Subject.CommonName != "" {
+		return []string{strings.ToLower(cert.Leaf.Subject.CommonName)}
+	}
+
+	names := make([]string, len(cert.Leaf.DNSNames))
+	for i, name := range cert.Leaf.DNSNames {
+		names[i] = strings.ToLower(name)
+	}
+	return names
+}
+
+// certStore selects the certificate for a TLS handshake by SNI.
+// Route certificates are preferred, then certificates from the TLS
+// config by exact name and then by wildcard, then ACME and finally
+// the default certificate.
+type certStore struct {
+	fallback *certFile
+	files    []*certFile
+	acme     *acmeManager
+	routes   func() *routeTable
+
+	mu    sync.RWMutex
+	names map[string]*certFile
+}
+
+// newCertStore loads the default certificate and any
+// additional certificates from the TLS config.
+func newCertStore(cfg *TLS, routes func() *routeTable) (*certStore, error) {
+	s := &certStore{routes: routes}
+
+	def := KeyPair{
+		CertFile:  cfg.CertFile,
+		KeyFile:   cfg.KeyFile,
+		CertBlock: cfg.CertBlock,
+		KeyBlock:  cfg.KeyBlock,
+	}
+	if !def.empty() {
+		f, err := loadCertFile(def)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read TLS certificate")
+		}
+		s.fallback = f
+	}
+
+	for i, pair := range cfg.Certificates {
+		f, err := loadCertFile(pair)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read TLS certificate %d", i)
+		}
+		s.files = append(s.files, f)
+	}
+	s.index()
+
+	return s, nil
+}
+
+// index maps the names covered by each certificate to it. The
+// first certificate listed wins when two cover the same name.
+func (s *certStore) index() {
+	names := map[string]*certFile{}
+	for _, f := range s.files {
+		for _, name := range certNames(f.get()) {
+			if _, ok := names[name]; !ok {
+				names[name] = f
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.names = names
+	s.mu.Unlock()
+}
+
+// named returns the certificate listed for name, exactly or by wildcard.
+func (s *certStore) named(name string) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if f := s.names[name]; f != nil {
+		return f.get()
+	}
+
+	// a wildcard only covers a single label.
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if f := s.names["*"+name[i:]]; f != nil {
+			return f.get()
+		}
+	}
+
+	return nil
+}
+
+// lookup returns the certificate configured for name, without
+// consulting ACME or falling back to the default.
+func (s *certStore) lookup(name string) *tls.Certificate {
+	if f := s.routes().certs[name]; f != nil {
+		return f.get()
+	}
+
+	return s.named(name)
+}
+
+// acmeHosts returns the route hosts that no configured certificate
+// covers, which are the ones ACME issues certificates for.
+func (s *certStore) acmeHosts() []string {
+	var hosts []string
+	for _, name := range s.routes().hostnames() {
+		if s.lookup(name) == nil {
+			hosts = append(hosts, name)
+		}
+	}
+
+	return hosts
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil && len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeALPNProto {
+		return s.acme.GetCertificate(hello)
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert := s.lookup(name); cert != nil {
+		return cert, nil
+	}
+
+	if s.acme != nil {
+		cert, err := s.acme.GetCertificate(hello)
+		if cert != nil || (err != nil && s.fallback == nil) {
+			return cert, err
+		}
+	}
+
+	if s.fallback == nil {
+		return nil, errors.Errorf("no certificate for %q", name)
+	}
+
+	return s.fallback.get(), nil
+}
+
+// check returns an error for the first TLS route whose
+// host no certificate covers.
+func (s *certStore) check(t *routeTable) error {
+	for _, key := range t.sortedKeys() {
+		r := t.keys[key]
+		if r.TLS == nil {
+			continue
+		}
+
+		name := hostname(r.Host)
+		if t.certs[name] != nil || s.named(name) != nil {
+			continue
+		}
+
+		if s.acme != nil && net.ParseIP(name) == nil && !strings.Contains(name, "*") {
+			continue
+		}
+
+		if s.fallback != nil && s.fallback.get().Leaf.VerifyHostname(name) == nil {
+			continue
+		}
+
+		return errors.Errorf("route %s is served over TLS but no certificate matches %s", key, name)
+	}
+
+	return nil
+}
+
+// reload reads every certificate whose files changed, logging
+// the new expiry or why the current certificate was kept.
+func (s *certStore) reload(logger Logger) {
+	files := append([]*certFile{}, s.files...)
+	if s.fallback != nil {
+		files = append(files, s.fallback)
+	}
+	for _, f := range s.routes().certs {
+		files = append(files, f)
+	}
+
+	for _, f := range files {
+		cert, err := f.reload()
+		switch {
+		case err != nil:
+			logger.Log(logging.Entry{
+				Timestamp: time.Now().UTC(),
+				Severity:  logging.Error,
+				Labels:    map[string]string{"certFile": f.pair.CertFile},
+				Payload:   "Rejected certificate reload: " + err.Error(),
+			})
+		case cert != nil:
+			logger.Log(logging.Entry{
+				Timestamp: time.Now().UTC(),
+				Severity:  logging.Info,
+				Labels: map[string]string{
+					"certFile": f.pair.CertFile,
+					"notAfter": cert.Leaf.NotAfter.UTC().Format(time.RFC3339),
+				},
+				Payload: "Reloaded certificate",
+			})
+		}
+	}
+
+	s.index()
+}
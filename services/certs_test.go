@@ -0,0 +1,204 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// writeCertificate writes a self-signed certificate for names
+// to dir and returns the certificate and key file paths.
+func writeCertificate(t *testing.T, dir, file string, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, file+".crt")
+	keyFile := filepath.Join(dir, file+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defCert, defKey := writeCertificate(t, dir, "default", "default.test")
+	aCert, aKey := writeCertificate(t, dir, "a", "a.test")
+	wildCert, wildKey := writeCertificate(t, dir, "wild", "*.wild.test")
+	routeCert, routeKey := writeCertificate(t, dir, "route", "route.test")
+
+	table, err := newRouteTable(Routes{
+		{Host: "route.test", Target: "http://localhost", TLS: &RouteTLS{CertFile: routeCert, KeyFile: routeKey}},
+		{Host: "a.test", Target: "http://localhost", TLS: &RouteTLS{}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	store, err := newCertStore(&TLS{
+		CertFile: defCert,
+		KeyFile:  defKey,
+		Certificates: []KeyPair{
+			{CertFile: aCert, KeyFile: aKey},
+			{CertFile: wildCert, KeyFile: wildKey},
+		},
+	}, func() *routeTable { return table })
+	if err != nil {
+		t.Fatalf("failed to create cert store: %v", err)
+	}
+
+	for name, expected := range map[string]string{
+		"route.test":       "route.test",
+		"A.test.":          "a.test",
+		"x.wild.test":      "*.wild.test",
+		"y.x.wild.test":    "default.test",
+		"wild.test":        "default.test",
+		"unknown.test":     "default.test",
+		"":                 "default.test",
+		"route.test.other": "default.test",
+	} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Errorf("failed to get certificate for %q: %v", name, err)
+			continue
+		}
+		if cert.Leaf.DNSNames[0] != expected {
+			t.Errorf("expected %q to be served %s, received %s", name, expected, cert.Leaf.DNSNames[0])
+		}
+	}
+
+	if err := store.check(table); err != nil {
+		t.Errorf("expected routes to be covered: %v", err)
+	}
+
+	missing, err := newRouteTable(Routes{
+		{Host: "missing.test", Target: "http://localhost", TLS: &RouteTLS{}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+	if err := store.check(missing); err == nil || !strings.Contains(err.Error(), "missing.test") {
+		t.Errorf("expected uncovered route to be reported, received %v", err)
+	}
+
+	if _, err := compileRoute(Route{
+		Host:   "other.test",
+		Target: "http://localhost",
+		TLS:    &RouteTLS{CertFile: routeCert, KeyFile: routeKey},
+	}); err == nil {
+		t.Error("expected certificate not matching the route host to be rejected")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	if err := view.Register(Views...); err != nil {
+		t.Fatalf("failed to register views: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "butler-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, "reload", "reload.test")
+	store, err := newCertStore(&TLS{CertFile: certFile, KeyFile: keyFile}, func() *routeTable {
+		return &routeTable{}
+	})
+	if err != nil {
+		t.Fatalf("failed to create cert store: %v", err)
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "reload.test"}
+	first, _ := store.GetCertificate(hello)
+
+	// file times may not change within the same second, so
+	// each rotation moves them forward explicitly.
+	touch := func(offset time.Duration) {
+		when := time.Now().Add(offset)
+		os.Chtimes(certFile, when, when)
+		os.Chtimes(keyFile, when, when)
+	}
+
+	writeCertificate(t, dir, "reload", "reload.test")
+	touch(time.Minute)
+	store.reload(logger)
+
+	second, _ := store.GetCertificate(hello)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Fatal("expected the rotated certificate to be served")
+	}
+
+	// a certificate that doesn't match its key is rejected.
+	otherCert, _ := writeCertificate(t, dir, "other", "reload.test")
+	data, err := ioutil.ReadFile(otherCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(2 * time.Minute)
+	store.reload(logger)
+
+	third, _ := store.GetCertificate(hello)
+	if !bytes.Equal(second.Certificate[0], third.Certificate[0]) {
+		t.Error("expected the previous certificate to be kept")
+	}
+
+	rows, err := view.RetrieveData("butler/tls/certificate_expiry_seconds")
+	if err != nil {
+		t.Fatalf("failed to retrieve expiry: %v", err)
+	}
+	for _, row := range rows {
+		if len(row.Tags) == 1 && row.Tags[0].Value == "reload.test" {
+			if expiry := row.Data.(*view.LastValueData).Value; expiry != float64(second.Leaf.NotAfter.Unix()) {
+				t.Errorf("expected expiry %d, received %v", second.Leaf.NotAfter.Unix(), expiry)
+			}
+			return
+		}
+	}
+	t.Error("expected certificate expiry to be recorded")
+}
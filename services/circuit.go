@@ -0,0 +1,539 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+)
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// circuitLevels are the values recorded for each state.
+var circuitLevels = map[string]int64{
+	CircuitClosed:   0,
+	CircuitHalfOpen: 1,
+	CircuitOpen:     2,
+}
+
+// Upstream events reported to the handler besides health changes.
+const (
+	eventCircuitOpened   = "Circuit breaker opened"
+	eventCircuitHalfOpen = "Circuit breaker half-open"
+	eventCircuitClosed   = "Circuit breaker closed"
+	eventEjected         = "Upstream ejected"
+	eventReturned        = "Upstream returned"
+)
+
+const (
+	defaultCircuitWindow      = 10 * time.Second
+	defaultCircuitMinRequests = 20
+	defaultCircuitOpenTimeout = 30 * time.Second
+	defaultHalfOpenRequests   = 1
+
+	defaultOutlierFailures    = 5
+	defaultBaseEjectionTime   = 30 * time.Second
+	defaultMaxEjectionTime    = 5 * time.Minute
+	defaultMaxEjectionPercent = 50
+)
+
+// CircuitBreaker stops sending requests to an upstream that keeps
+// failing. The breaker opens after ConsecutiveFailures failures in a
+// row, or once at least MinRequests requests made within Window failed
+// at ErrorRate (0 to 1) or more. After OpenTimeout it lets
+// HalfOpenRequests requests through and closes again if they all
+// succeed. MaxConcurrent limits the requests in flight to each
+// upstream regardless of its state.
+//
+// Failures are connection errors, timeouts and 5xx responses.
+type CircuitBreaker struct {
+	ConsecutiveFailures int      `json:"consecutiveFailures,omitempty"`
+	ErrorRate           float64  `json:"errorRate,omitempty"`
+	Window              Duration `json:"window,omitempty"`
+	MinRequests         int      `json:"minRequests,omitempty"`
+	MaxConcurrent       int64    `json:"maxConcurrent,omitempty"`
+	OpenTimeout         Duration `json:"openTimeout,omitempty"`
+	HalfOpenRequests    int      `json:"halfOpenRequests,omitempty"`
+}
+
+func (c *CircuitBreaker) validate() error {
+	if c.ConsecutiveFailures < 0 || c.MinRequests < 0 || c.MaxConcurrent < 0 || c.HalfOpenRequests < 0 {
+		return errors.New("circuit breaker limits must not be negative")
+	}
+
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return errors.Errorf("circuit breaker error rate must be between 0 and 1: %v", c.ErrorRate)
+	}
+
+	if c.ConsecutiveFailures == 0 && c.ErrorRate == 0 && c.MaxConcurrent == 0 {
+		return errors.New("circuit breaker needs consecutiveFailures, errorRate or maxConcurrent")
+	}
+
+	if c.Window == 0 {
+		c.Window = Duration(defaultCircuitWindow)
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = defaultCircuitMinRequests
+	}
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = Duration(defaultCircuitOpenTimeout)
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = defaultHalfOpenRequests
+	}
+
+	return nil
+}
+
+// OutlierDetection temporarily ejects an upstream from the route after
+// ConsecutiveFailures failed requests. Each ejection lasts
+// BaseEjectionTime times the number of times the upstream has been
+// ejected, up to MaxEjectionTime, counting from the last time it stayed
+// in rotation for MaxEjectionTime. No more than MaxEjectionPercent of
+// the route's upstreams are ejected at once.
+type OutlierDetection struct {
+	ConsecutiveFailures int      `json:"consecutiveFailures,omitempty"`
+	BaseEjectionTime    Duration `json:"baseEjectionTime,omitempty"`
+	MaxEjectionTime     Duration `json:"maxEjectionTime,omitempty"`
+	MaxEjectionPercent  int      `json:"maxEjectionPercent,omitempty"`
+}
+
+func (o *OutlierDetection) validate() error {
+	if o.ConsecutiveFailures < 0 || o.BaseEjectionTime < 0 || o.MaxEjectionTime < 0 {
+		return errors.New("outlier detection limits must not be negative")
+	}
+
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return errors.Errorf("max ejection percent must be between 0 and 100: %d", o.MaxEjectionPercent)
+	}
+
+	if o.ConsecutiveFailures == 0 {
+		o.ConsecutiveFailures = defaultOutlierFailures
+	}
+	if o.BaseEjectionTime == 0 {
+		o.BaseEjectionTime = Duration(defaultBaseEjectionTime)
+	}
+	if o.MaxEjectionTime == 0 {
+		o.MaxEjectionTime = Duration(defaultMaxEjectionTime)
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	return nil
+}
+
+// outcome is how an upstream request went, as far as
+// circuit breaking and outlier detection are concerned.
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeIgnored is a request abandoned by the client,
+	// which says nothing about the upstream.
+	outcomeIgnored
+)
+
+// requestOutcome classifies the result of an upstream round trip.
+func requestOutcome(res *http.Response, err error) outcome {
+	switch {
+	case err != nil && errorType(err) == "canceled":
+		return outcomeIgnored
+	case err != nil, res.StatusCode >= http.StatusInternalServerError:
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
+
+// circuitBreaker is the breaker of a single backend.
+type circuitBreaker struct {
+	cfg CircuitBreaker
+
+	mu       sync.Mutex
+	state    string
+	openedAt time.Time
+	// probes are the half-open requests in flight and
+	// passed those that have succeeded.
+	probes, passed int
+	consecutive    int
+
+	// counts holds the requests and failures
+	// the error rate is estimated from.
+	counts windowCounts
+}
+
+func newCircuitBreaker(cfg CircuitBreaker) *circuitBreaker {
+	return &circuitBreaker{
+		cfg:    cfg,
+		state:  CircuitClosed,
+		counts: windowCounts{window: time.Duration(cfg.Window)},
+	}
+}
+
+// State returns the breaker's state.
+func (c *circuitBreaker) State() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+// allows reports whether the breaker would let a request through.
+func (c *circuitBreaker) allows(now time.Time, outstanding int64) bool {
+	if c.cfg.MaxConcurrent > 0 && outstanding >= c.cfg.MaxConcurrent {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.allowsLocked(now)
+}
+
+func (c *circuitBreaker) allowsLocked(now time.Time) bool {
+	switch c.state {
+	case CircuitOpen:
+		return now.Sub(c.openedAt) >= time.Duration(c.cfg.OpenTimeout)
+	case CircuitHalfOpen:
+		return c.probes < c.cfg.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// acquire admits a request, returning the state the breaker
+// moved to when the request starts probing an open breaker. The
+// request's slot under MaxConcurrent is reserved by the route.
+func (c *circuitBreaker) acquire(now time.Time) (bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.allowsLocked(now) {
+		return false, ""
+	}
+
+	var changed string
+	if c.state == CircuitOpen {
+		c.state, c.probes, c.passed = CircuitHalfOpen, 0, 0
+		changed = CircuitHalfOpen
+	}
+
+	if c.state == CircuitHalfOpen {
+		c.probes++
+	}
+
+	return true, changed
+}
+
+// result records the outcome of an admitted request and returns the
+// state the breaker moved to, if it changed, and why.
+func (c *circuitBreaker) result(now time.Time, o outcome) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		// the request started before the breaker opened.
+		return "", ""
+	case CircuitHalfOpen:
+		// requests started while the breaker was
+		// still closed aren't probes.
+		if c.probes > 0 {
+			c.probes--
+		}
+		switch o {
+		case outcomeFailure:
+			c.open(now)
+			return CircuitOpen, "probe request failed"
+		case outcomeSuccess:
+			c.passed++
+			if c.passed >= c.cfg.HalfOpenRequests {
+				c.state = CircuitClosed
+				c.consecutive = 0
+				c.counts.reset()
+				return CircuitClosed, fmt.Sprintf("%d probe requests succeeded", c.passed)
+			}
+		}
+		return "", ""
+	}
+
+	if o == outcomeIgnored {
+		return "", ""
+	}
+
+	failed := 0
+	if o == outcomeFailure {
+		failed = 1
+	}
+	requests, failures := c.counts.add(now, 1, failed)
+
+	if o == outcomeFailure {
+		c.consecutive++
+	} else {
+		c.consecutive = 0
+	}
+
+	if c.cfg.ConsecutiveFailures > 0 && c.consecutive >= c.cfg.ConsecutiveFailures {
+		c.open(now)
+		return CircuitOpen, fmt.Sprintf("%d consecutive failures", c.consecutive)
+	}
+
+	if c.cfg.ErrorRate > 0 && requests >= float64(c.cfg.MinRequests) && failures/requests >= c.cfg.ErrorRate {
+		c.open(now)
+		return CircuitOpen, fmt.Sprintf("%.0f%% of requests failed", 100*failures/requests)
+	}
+
+	return "", ""
+}
+
+func (c *circuitBreaker) open(now time.Time) {
+	c.state = CircuitOpen
+	c.openedAt = now
+	c.probes, c.passed = 0, 0
+}
+
+// windowCounts estimates two counts over a sliding window by weighting
+// the counts of the previous fixed window by how much of it still
+// overlaps the sliding one.
+type windowCounts struct {
+	window    time.Duration
+	start     time.Time
+	prev, cur [2]int
+}
+
+// add adds a and b to the counts and returns their estimates.
+func (w *windowCounts) add(now time.Time, a, b int) (float64, float64) {
+	if w.start.IsZero() {
+		w.start = now
+	}
+
+	elapsed := now.Sub(w.start)
+	if elapsed >= w.window {
+		windows := elapsed / w.window
+		if windows == 1 {
+			w.prev = w.cur
+		} else {
+			w.prev = [2]int{}
+		}
+		w.cur = [2]int{}
+		w.start = w.start.Add(windows * w.window)
+		elapsed = now.Sub(w.start)
+	}
+
+	w.cur[0] += a
+	w.cur[1] += b
+
+	overlap := 1 - float64(elapsed)/float64(w.window)
+	return float64(w.prev[0])*overlap + float64(w.cur[0]),
+		float64(w.prev[1])*overlap + float64(w.cur[1])
+}
+
+func (w *windowCounts) reset() {
+	w.start, w.prev, w.cur = time.Time{}, [2]int{}, [2]int{}
+}
+
+// outlierDetector tracks consecutive failures of a route's
+// backends and ejects those that keep failing.
+type outlierDetector struct {
+	cfg OutlierDetection
+
+	mu    sync.Mutex
+	hosts map[*Backend]*outlierState
+}
+
+type outlierState struct {
+	failures  int
+	ejections int
+	until     time.Time
+	// returned is when the backend last came back into rotation,
+	// or the zero time while it is ejected.
+	returned time.Time
+}
+
+func newOutlierDetector(cfg OutlierDetection) *outlierDetector {
+	return &outlierDetector{cfg: cfg, hosts: map[*Backend]*outlierState{}}
+}
+
+func (d *outlierDetector) host(b *Backend) *outlierState {
+	s, ok := d.hosts[b]
+	if !ok {
+		s = &outlierState{}
+		d.hosts[b] = s
+	}
+
+	return s
+}
+
+// ejectedUntil returns when the backend's current ejection ends,
+// or the zero time when it isn't ejected.
+func (d *outlierDetector) ejectedUntil(b *Backend) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.host(b).until
+}
+
+// admit reports whether the backend is in rotation and whether
+// it has just returned from an ejection.
+func (d *outlierDetector) admit(b *Backend, now time.Time) (bool, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.host(b)
+	switch {
+	case s.until.IsZero():
+		return true, false
+	case now.Before(s.until):
+		return false, false
+	default:
+		s.until, s.returned = time.Time{}, now
+		return true, true
+	}
+}
+
+// result records the outcome of a request to b out of the route's
+// backends and returns how long b was ejected for, if it was.
+func (d *outlierDetector) result(b *Backend, backends []*Backend, now time.Time, o outcome) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.host(b)
+	switch o {
+	case outcomeIgnored:
+		return 0
+	case outcomeSuccess:
+		s.failures = 0
+		// an upstream that has stayed in long enough since
+		// its last ejection starts over with the shortest one.
+		if s.ejections > 0 && !s.returned.IsZero() && now.Sub(s.returned) > time.Duration(d.cfg.MaxEjectionTime) {
+			s.ejections = 0
+		}
+		return 0
+	}
+
+	s.failures++
+	if s.failures < d.cfg.ConsecutiveFailures || now.Before(s.until) {
+		return 0
+	}
+
+	ejected := 0
+	for _, other := range backends {
+		if now.Before(d.host(other).until) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > d.cfg.MaxEjectionPercent*len(backends) {
+		return 0
+	}
+
+	s.failures = 0
+	s.ejections++
+	duration := time.Duration(d.cfg.BaseEjectionTime) * time.Duration(s.ejections)
+	if max := time.Duration(d.cfg.MaxEjectionTime); duration > max {
+		duration = max
+	}
+	s.until, s.returned = now.Add(duration), time.Time{}
+
+	return duration
+}
+
+// available reports whether b could take a request, without
+// admitting one.
+func (r *route) available(b *Backend, now time.Time) bool {
+	if r.outlier != nil {
+		if until := r.outlier.ejectedUntil(b); now.Before(until) {
+			return false
+		}
+	}
+
+	return b.circuit == nil || b.circuit.allows(now, b.Outstanding())
+}
+
+// acquire admits a request to b, reserving one of its slots, and
+// reports any change in the backend's state along the way. The slot
+// must be given back with release once the request is done.
+func (r *route) acquire(b *Backend, now time.Time) bool {
+	if r.outlier != nil {
+		ok, returned := r.outlier.admit(b, now)
+		if !ok {
+			return false
+		}
+		if returned {
+			r.upstreamChanged(b, eventReturned, "ejection ended")
+		}
+	}
+
+	if b.circuit == nil {
+		b.reserve(0)
+		return true
+	}
+
+	// the slot is taken before the breaker is asked, so concurrent
+	// requests can't all see the last slot free.
+	if !b.reserve(b.circuit.cfg.MaxConcurrent) {
+		return false
+	}
+
+	ok, state := b.circuit.acquire(now)
+	if state != "" {
+		r.circuitChanged(b, state, "open timeout elapsed")
+	}
+	if !ok {
+		b.release()
+	}
+
+	return ok
+}
+
+// report records the outcome of a request admitted by acquire.
+func (r *route) report(b *Backend, o outcome) {
+	now := time.Now()
+	if b.circuit != nil {
+		if state, reason := b.circuit.result(now, o); state != "" {
+			r.circuitChanged(b, state, reason)
+		}
+	}
+
+	if r.outlier != nil {
+		if d := r.outlier.result(b, r.backends, now, o); d > 0 {
+			record(context.Background(), []tag.Mutator{
+				tag.Upsert(keyRoute, r.key),
+				tag.Upsert(keyUpstream, b.URL.Host),
+			}, outlierEjections.M(1))
+			r.upstreamChanged(b, eventEjected, fmt.Sprintf("%d consecutive failures, ejected for %s", r.outlier.cfg.ConsecutiveFailures, d))
+		}
+	}
+}
+
+func (r *route) circuitChanged(b *Backend, state, reason string) {
+	record(context.Background(), []tag.Mutator{
+		tag.Upsert(keyRoute, r.key),
+		tag.Upsert(keyUpstream, b.URL.Host),
+	}, circuitState.M(circuitLevels[state]))
+
+	switch state {
+	case CircuitOpen:
+		r.upstreamChanged(b, eventCircuitOpened, reason)
+	case CircuitHalfOpen:
+		r.upstreamChanged(b, eventCircuitHalfOpen, reason)
+	default:
+		r.upstreamChanged(b, eventCircuitClosed, reason)
+	}
+}
+
+func (r *route) upstreamChanged(b *Backend, event, reason string) {
+	if r.onUpstreamChange != nil {
+		r.onUpstreamChange(r.key, b, event, reason)
+	}
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := CircuitBreaker{ConsecutiveFailures: 3, OpenTimeout: Duration(time.Second), HalfOpenRequests: 2}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := newCircuitBreaker(cfg)
+	now := time.Unix(0, 0)
+
+	request := func(o outcome) string {
+		if ok, _ := c.acquire(now); !ok {
+			t.Fatalf("expected a %s breaker to admit the request", c.State())
+		}
+		state, _ := c.result(now, o)
+		return state
+	}
+
+	request(outcomeFailure)
+	request(outcomeFailure)
+	request(outcomeSuccess)
+	request(outcomeFailure)
+	request(outcomeIgnored)
+	request(outcomeFailure)
+	if state := request(outcomeFailure); state != CircuitOpen {
+		t.Fatalf("expected 3 consecutive failures to open the breaker, received %q", state)
+	}
+
+	if ok, _ := c.acquire(now.Add(500 * time.Millisecond)); ok {
+		t.Fatal("expected an open breaker to reject requests")
+	}
+
+	now = now.Add(time.Second)
+	ok, state := c.acquire(now)
+	if !ok || state != CircuitHalfOpen {
+		t.Fatalf("expected the breaker to let a probe through, received %v %q", ok, state)
+	}
+	if ok, _ := c.acquire(now); !ok {
+		t.Fatal("expected a second probe to be admitted")
+	}
+	if ok, _ := c.acquire(now); ok {
+		t.Fatal("expected no more than 2 probes at once")
+	}
+
+	if state, _ := c.result(now, outcomeFailure); state != CircuitOpen {
+		t.Fatalf("expected a failed probe to reopen the breaker, received %q", state)
+	}
+	c.result(now, outcomeSuccess)
+
+	now = now.Add(time.Second)
+	request(outcomeSuccess)
+	if state := request(outcomeSuccess); state != CircuitClosed {
+		t.Fatalf("expected successful probes to close the breaker, received %q", state)
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	cfg := CircuitBreaker{ErrorRate: 0.5, MinRequests: 4, Window: Duration(10 * time.Second)}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := newCircuitBreaker(cfg)
+	now := time.Unix(0, 0)
+
+	for _, o := range []outcome{outcomeFailure, outcomeSuccess, outcomeFailure} {
+		if state, _ := c.result(now, o); state != "" {
+			t.Fatalf("expected the breaker to wait for enough requests, received %q", state)
+		}
+	}
+
+	// the failures slide out of the window as time passes.
+	now = now.Add(19 * time.Second)
+	if state, _ := c.result(now, outcomeSuccess); state != "" {
+		t.Fatalf("expected the old failures not to count, received %q", state)
+	}
+
+	for _, o := range []outcome{outcomeSuccess, outcomeFailure} {
+		c.result(now, o)
+	}
+	state, reason := c.result(now, outcomeFailure)
+	if state != CircuitOpen {
+		t.Fatalf("expected the error rate to open the breaker, received %q", state)
+	}
+	if reason != "51% of requests failed" {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+}
+
+func TestCircuitBreakerConcurrency(t *testing.T) {
+	cfg := CircuitBreaker{MaxConcurrent: 2}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := newCircuitBreaker(cfg)
+
+	if !c.allows(time.Now(), 1) {
+		t.Error("expected a request under the limit to be allowed")
+	}
+	if c.allows(time.Now(), 2) {
+		t.Error("expected a request over the limit to be rejected")
+	}
+
+	r, err := compileRoute(Route{Host: "limited.test", Target: "http://10.0.0.1", CircuitBreaker: &cfg})
+	if err != nil {
+		t.Fatalf("failed to compile route: %v", err)
+	}
+	b := r.backends[0]
+
+	// every request checks the limit at once, before any is sent.
+	var admitted int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if r.acquire(b, time.Now()) {
+				atomic.AddInt32(&admitted, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if admitted != 2 || b.Outstanding() != 2 {
+		t.Errorf("expected exactly 2 concurrent requests to be admitted, admitted %d with %d outstanding", admitted, b.Outstanding())
+	}
+
+	b.release()
+	b.circuit.mu.Lock()
+	b.circuit.open(time.Now())
+	b.circuit.mu.Unlock()
+	if r.acquire(b, time.Now()) || b.Outstanding() != 1 {
+		t.Errorf("expected an open breaker to give back the slot it rejected, %d outstanding", b.Outstanding())
+	}
+
+	for _, invalid := range []CircuitBreaker{
+		{},
+		{ErrorRate: 1.5},
+		{ConsecutiveFailures: -1},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+
+	r, err := compileRoute(Route{
+		Host:      "butler-proxy",
+		Upstreams: []Upstream{{URL: good.URL}, {URL: bad.URL}},
+		OutlierDetection: &OutlierDetection{
+			ConsecutiveFailures: 2,
+			BaseEjectionTime:    Duration(time.Hour),
+			MaxEjectionTime:     Duration(2 * time.Hour),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile route: %v", err)
+	}
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	r.start(nil, func(route string, b *Backend, event, reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event+": "+reason)
+	})
+	defer r.close()
+
+	statuses := map[int]int{}
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		r.proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		statuses[rec.Code]++
+	}
+
+	if statuses[http.StatusBadGateway] != 2 || statuses[http.StatusOK] != 8 {
+		t.Errorf("expected the failing upstream to be ejected after 2 failures, received %v", statuses)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != eventEjected+": 2 consecutive failures, ejected for 1h0m0s" {
+		t.Errorf("unexpected events: %v", events)
+	}
+
+	// the last upstream standing isn't ejected.
+	r.outlier.result(r.backends[0], r.backends, time.Now(), outcomeFailure)
+	if d := r.outlier.result(r.backends[0], r.backends, time.Now(), outcomeFailure); d != 0 {
+		t.Errorf("expected max ejection percent to keep the good upstream, ejected for %s", d)
+	}
+}
+
+func TestOutlierEjectionBackoff(t *testing.T) {
+	d := newOutlierDetector(OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    Duration(time.Minute),
+		MaxEjectionTime:     Duration(10 * time.Minute),
+		MaxEjectionPercent:  100,
+	})
+	b := &Backend{}
+	backends := []*Backend{b}
+
+	now := time.Now()
+	eject := func() time.Duration {
+		t.Helper()
+		duration := d.result(b, backends, now, outcomeFailure)
+		if duration == 0 {
+			t.Fatal("expected the backend to be ejected")
+		}
+
+		now = now.Add(duration)
+		if ok, returned := d.admit(b, now); !ok || !returned {
+			t.Fatal("expected the backend to return once its ejection ended")
+		}
+		d.result(b, backends, now, outcomeSuccess)
+		return duration
+	}
+
+	if first, second := eject(), eject(); second <= first {
+		t.Errorf("expected the second ejection to be longer than the first, received %s then %s", first, second)
+	}
+
+	// staying healthy for MaxEjectionTime starts over.
+	now = now.Add(11 * time.Minute)
+	d.result(b, backends, now, outcomeSuccess)
+	if duration := eject(); duration != time.Minute {
+		t.Errorf("expected a healthy backend to start over at the base ejection time, received %s", duration)
+	}
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Headers set on requests to upstreams of routes that forward
+// the verified client certificate.
+const (
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertSAN         = "X-Client-Cert-San"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// clientCertHeaderPrefix is stripped from every proxied request so
+// upstreams only ever see certificate headers butler set itself.
+const clientCertHeaderPrefix = "X-Client-Cert-"
+
+// clientAuth verifies client certificates for a route.
+type clientAuth struct {
+	roots   *x509.CertPool
+	allowed []*regexp.Regexp
+	forward bool
+}
+
+// newClientAuth returns nil when the route doesn't require
+// client certificates.
+func newClientAuth(cfg *RouteTLS) (*clientAuth, error) {
+	if cfg == nil || cfg.ClientCA == "" {
+		if cfg != nil && (len(cfg.AllowedSubjects) > 0 || cfg.ForwardClientCert) {
+			return nil, errors.New("allowedSubjects and forwardClientCert require a clientCA")
+		}
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read client CA")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificates found in %s", cfg.ClientCA)
+	}
+
+	a := &clientAuth{roots: roots, forward: cfg.ForwardClientCert}
+	for _, pattern := range cfg.AllowedSubjects {
+		re, err := regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid subject pattern %q", pattern)
+		}
+		a.allowed = append(a.allowed, re)
+	}
+
+	return a, nil
+}
+
+// verify checks the client certificate presented on the
+// connection and returns it.
+func (a *clientAuth) verify(state *tls.ConnectionState) (*x509.Certificate, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, errors.New("client certificate required")
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, errors.Wrap(err, "invalid client certificate")
+	}
+
+	if len(a.allowed) == 0 {
+		return leaf, nil
+	}
+
+	for _, name := range subjectNames(leaf) {
+		for _, re := range a.allowed {
+			if re.MatchString(name) {
+				return leaf, nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("client certificate %q is not allowed", leaf.Subject.CommonName)
+}
+
+// subjectNames returns the common name and SANs of a certificate.
+func subjectNames(cert *x509.Certificate) []string {
+	if cert.Subject.CommonName == "" {
+		return certSANs(cert)
+	}
+
+	return append([]string{cert.Subject.CommonName}, certSANs(cert)...)
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	return sans
+}
+
+// stripClientCertHeaders removes any certificate headers
+// sent by the client.
+func stripClientCertHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, clientCertHeaderPrefix) {
+			delete(h, k)
+		}
+	}
+}
+
+// forwardHeaders sets the details of the verified certificate
+// on a request already stripped of the client's own.
+func (a *clientAuth) forwardHeaders(h http.Header, leaf *x509.Certificate) {
+	if !a.forward {
+		return
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	h.Set(HeaderClientCertSubject, leaf.Subject.String())
+	h.Set(HeaderClientCertSAN, strings.Join(certSANs(leaf), ","))
+	h.Set(HeaderClientCertFingerprint, hex.EncodeToString(fingerprint[:]))
+}
+
+// configForClient asks for a client certificate during the handshake
+// when a route for the requested host requires one. The certificate
+// is verified per route once the request has been routed.
+func (s *certStore) configForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+		if !s.routes().clientAuth[name] {
+			return nil, nil
+		}
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = tls.RequestClientCert
+		return cfg, nil
+	}
+}
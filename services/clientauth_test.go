@@ -0,0 +1,194 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn + ".internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler-mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, other := newTestCA(t), newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(HeaderClientCertSubject) + " " + r.Header.Get(HeaderClientCertSAN)))
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{
+			Host:   "mtls.test",
+			Target: upstream.URL,
+			TLS: &RouteTLS{
+				ClientCA:          caFile,
+				AllowedSubjects:   []string{"client-*"},
+				ForwardClientCert: true,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	certFile, keyFile := writeCertificate(t, dir, "server", "mtls.test")
+	store, err := newCertStore(&TLS{CertFile: certFile, KeyFile: keyFile}, func() *routeTable { return table })
+	if err != nil {
+		t.Fatalf("failed to create cert store: %v", err)
+	}
+
+	h := &handler{logger: logger, certs: store}
+	h.setTable(table)
+
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{GetCertificate: store.GetCertificate}
+	srv.TLS.GetConfigForClient = store.configForClient(srv.TLS)
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(certs ...tls.Certificate) (int, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         "mtls.test",
+				InsecureSkipVerify: true,
+				Certificates:       certs,
+			},
+		}}
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Host = "mtls.test"
+		req.Header.Set(HeaderClientCertSubject, "CN=spoofed")
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if status, body := get(ca.issue(t, "client-a")); status != http.StatusOK || body != "CN=client-a client-a.internal" {
+		t.Errorf("expected allowed client to be forwarded, received %d %q", status, body)
+	}
+
+	if status, _ := get(); status != http.StatusForbidden {
+		t.Errorf("expected request without a certificate to be rejected, received %d", status)
+	}
+
+	if status, _ := get(ca.issue(t, "intruder")); status != http.StatusForbidden {
+		t.Errorf("expected subject outside the allow-list to be rejected, received %d", status)
+	}
+
+	if status, _ := get(other.issue(t, "client-b")); status != http.StatusForbidden {
+		t.Errorf("expected certificate from another CA to be rejected, received %d", status)
+	}
+}
+
+func TestClientCertHeadersStripped(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{{Host: "plain.test", Target: upstream.URL}}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	req := httptest.NewRequest(http.MethodGet, "http://plain.test/", nil)
+	req.Header.Set(HeaderClientCertSubject, "CN=spoofed")
+	req.Header.Set(HeaderClientCertFingerprint, "00")
+	req.Header.Set("X-Client-Cert-Issuer", "CN=spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if received == nil {
+		t.Fatal("expected the request to reach the upstream")
+	}
+	for k := range received {
+		if strings.HasPrefix(k, "X-Client-Cert-") {
+			t.Errorf("expected spoofed %s to be removed, received %q", k, received.Get(k))
+		}
+	}
+}
@@ -1,26 +1,83 @@
 package services
 
 import (
-	"context"
 	"encoding/json"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
 
-	"cloud.google.com/go/logging"
 	"github.com/pkg/errors"
 )
 
 const (
 	logName = "butler"
+
+	defaultReloadInterval = 5 * time.Second
+	defaultDrainTimeout   = 30 * time.Second
 )
 
 // Config defines parameters that will be used to start the
 // service and what targets to listen for.
 type Config struct {
-	ListenAddress string            `json:"listenAddress,omitempty"`
-	TLS           *TLS              `json:"tls,omitempty"`
-	Targets       map[string]string `json:"targets,omitempty"`
-	Logger        *logging.Logger
-	ProjectID     string
+	ListenAddress  string           `json:"listenAddress,omitempty"`
+	TLS            *TLS             `json:"tls,omitempty"`
+	Targets        Routes           `json:"targets,omitempty"`
+	ReloadInterval Duration         `json:"reloadInterval,omitempty"`
+	DrainTimeout   Duration         `json:"drainTimeout,omitempty"`
+	DrainDelay     Duration         `json:"drainDelay,omitempty"`
+	Timeouts       *ServerTimeouts  `json:"timeouts,omitempty"`
+	ReadinessPath  string           `json:"readinessPath,omitempty"`
+	Logging        *LogConfig       `json:"logging,omitempty"`
+	AccessLog      *AccessLogConfig `json:"accessLog,omitempty"`
+	Metrics        *MetricsConfig   `json:"metrics,omitempty"`
+	Tracing        *TracingConfig   `json:"tracing,omitempty"`
+	Admin          *AdminConfig     `json:"admin,omitempty"`
+	Logger         Logger           `json:"-"`
+	ProjectID      string
+
+	// TrustedProxies lists the addresses of proxies in front of
+	// butler whose forwarding headers are believed, and
+	// TrustedProxyHeader the one they record clients in:
+	// X-Forwarded-For (the default) or Forwarded. Access applies to
+	// every route, ahead of the route's own list.
+	TrustedProxies     []string    `json:"trustedProxies,omitempty"`
+	TrustedProxyHeader string      `json:"trustedProxyHeader,omitempty"`
+	Access             *AccessList `json:"access,omitempty"`
+
+	// file and envVar record where the configuration was
+	// read from so it can be read again on reload.
+	file   string
+	envVar string
+}
+
+// Duration is a time.Duration that can be decoded from either a
+// Go duration string ("30s", "1m") or a number of seconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if s, err := strconv.Unquote(string(data)); err == nil {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Errorf("invalid duration: %s", s)
+		}
+		*d = Duration(v)
+		return nil
+	}
+
+	secs, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return errors.Errorf("invalid duration: %s", data)
+	}
+	*d = Duration(secs * float64(time.Second))
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 // ReadConfig pulls the configuration from either a file parameter or
@@ -41,19 +98,133 @@ func ReadConfig(file *string, envVar *string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	cfg.ProjectID = os.Getenv("PROJECT_ID")
 
-	ctx := context.Background()
+	cfg.Logger, err = NewLogger(cfg.Logging, cfg.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that every route is well formed, that no two
+// routes share a host and path and that the access log format parses.
+func (c *Config) Validate() error {
+	if _, err := newRouteTable(c.Targets, nil); err != nil {
+		return err
+	}
+
+	if c.AccessLog != nil {
+		if _, err := accessLogFormat(c.AccessLog.Format); err != nil {
+			return err
+		}
+	}
+
+	if c.TLS != nil {
+		if _, err := c.TLS.serverConfig(); err != nil {
+			return err
+		}
+
+		if c.TLS.ACME != nil {
+			if err := c.TLS.ACME.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		return errors.Wrap(err, "invalid trusted proxies")
+	}
+
+	switch http.CanonicalHeaderKey(c.TrustedProxyHeader) {
+	case "", headerXForwardedFor, headerForwarded:
+	default:
+		return errors.Errorf("unknown trusted proxy header: %s", c.TrustedProxyHeader)
+	}
+
+	if _, err := newAccessList(c.Access); err != nil {
+		return err
+	}
+
+	if c.Timeouts != nil {
+		if err := c.Timeouts.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Admin != nil {
+		if err := c.Admin.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Tracing != nil {
+		if _, err := newSampler(c.Tracing.Sampler); err != nil {
+			return err
+		}
+
+		if _, err := newPropagation(c.Tracing.Propagation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reload reads the configuration again from wherever it was
+// originally read and validates it.
+func (c *Config) reload() (*Config, error) {
+	var next *Config
+	var err error
+	switch {
+	case c.file != "":
+		next, err = fromFile(c.file)
+	case c.envVar != "":
+		next, err = fromEnv(c.envVar)
+	default:
+		return nil, errors.New("configuration was not read from a file or environment variable")
+	}
 
-	// Creates a client.
-	client, err := logging.NewClient(ctx, cfg.ProjectID)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create client")
+		return nil, err
 	}
 
-	cfg.Logger = client.Logger(logName)
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
 
-	return cfg, nil
+	return next, nil
+}
+
+func (c *Config) reloadInterval() time.Duration {
+	if c.ReloadInterval <= 0 {
+		return defaultReloadInterval
+	}
+
+	return time.Duration(c.ReloadInterval)
+}
+
+func (c *Config) drainTimeout() time.Duration {
+	if c.DrainTimeout <= 0 {
+		return defaultDrainTimeout
+	}
+
+	return time.Duration(c.DrainTimeout)
+}
+
+// drainDelay is how long readiness fails before the servers stop
+// accepting connections.
+func (c *Config) drainDelay() time.Duration {
+	if c.DrainDelay <= 0 {
+		return 0
+	}
+
+	return time.Duration(c.DrainDelay)
 }
 
 func fromFile(file string) (*Config, error) {
@@ -69,13 +240,16 @@ func fromFile(file string) (*Config, error) {
 	if err != nil {
 		return nil, errors.Errorf("failed to read config file: %v", err)
 	}
+	defer f.Close()
 
-	var cfg *Config
-	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
 		return nil, errors.Errorf("failed to decode JSON: %v", err)
 	}
 
-	return cfg, nil
+	cfg.file = file
+
+	return &cfg, nil
 }
 
 func fromEnv(envVar string) (*Config, error) {
@@ -94,5 +268,7 @@ func fromEnv(envVar string) (*Config, error) {
 		return nil, errors.Errorf("failed to decode JSON: %v", err)
 	}
 
+	cfg.envVar = envVar
+
 	return &cfg, nil
 }
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers trusted proxies can record the client's address in.
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerForwarded     = "Forwarded"
+)
+
+// forwardingHeaders are the headers describing the original request
+// that are only believed when set by a trusted proxy.
+var forwardingHeaders = []string{
+	headerForwarded,
+	headerXForwardedFor,
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// setForwarded tells the upstream who made the request, to which host
+// and over which protocol, in both the RFC 7239 Forwarded header and
+// the X-Forwarded-* headers. Headers sent by a trusted proxy are
+// extended; anyone else's are replaced so clients can't spoof them.
+func (h *handler) setForwarded(r *request) {
+	header := r.request.Header
+	peer := remoteIP(r.request)
+
+	if peer == nil || !h.trusted.contains(peer) {
+		for _, name := range forwardingHeaders {
+			header.Del(name)
+		}
+	}
+
+	proto := "http"
+	if r.request.TLS != nil {
+		proto = "https"
+	}
+
+	if header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+	if header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", r.request.Host)
+	}
+
+	// the reverse proxy appends the peer to X-Forwarded-For itself.
+	element := "for=" + forwardedNode(peer) + ";host=" + forwardedValue(r.request.Host) + ";proto=" + proto
+	header.Set("Forwarded", strings.Join(append(header["Forwarded"], element), ", "))
+}
+
+// forwardedNode formats an address as a Forwarded node,
+// quoting and bracketing IPv6 addresses.
+func forwardedNode(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() == nil:
+		return `"[` + ip.String() + `]"`
+	default:
+		return ip.String()
+	}
+}
+
+// forwardedValue quotes v when it isn't a valid token.
+func forwardedValue(v string) string {
+	if v == "" || strings.ContainsAny(v, ":[]()<>@,;\\/?={} \t\"") {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+// forwardedHops returns the client addresses recorded by earlier
+// proxies in the named header, oldest first, reading X-Forwarded-For
+// unless name is Forwarded. Only the header the trusted proxies set
+// is read, as a client can send the other one through them.
+func forwardedHops(header http.Header, name string) []string {
+	var hops []string
+	if name == headerForwarded {
+		for _, v := range header[headerForwarded] {
+			for _, element := range splitQuoted(v, ',') {
+				hops = append(hops, forwardedParam(element, "for"))
+			}
+		}
+
+		return hops
+	}
+
+	for _, v := range header[headerXForwardedFor] {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// forwardedParam returns the named parameter of a Forwarded element.
+func forwardedParam(element, name string) string {
+	for _, pair := range splitQuoted(element, ';') {
+		i := strings.Index(pair, "=")
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), name) {
+			continue
+		}
+
+		v := strings.TrimSpace(pair[i+1:])
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			return unquoted
+		}
+		return v
+	}
+
+	return ""
+}
+
+// splitQuoted splits s on sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// parseNode parses an address as found in X-Forwarded-For or a
+// Forwarded node, with or without a port. Obfuscated and unknown
+// nodes return nil.
+func parseNode(node string) net.IP {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+}
+
+// remoteIP returns the address of the connection's peer.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "app.test", Target: upstream.URL},
+		{Host: "keep.test", Target: upstream.URL, PreserveHost: true},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+	h.trusted, _ = parseCIDRs([]string{"10.0.0.0/8"})
+
+	u, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name   string
+		host   string
+		remote string
+		header http.Header
+		expect map[string]string
+	}{
+		{
+			name:   "untrusted client",
+			host:   "app.test",
+			remote: "203.0.113.7:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Host":  {"evil.test"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=198.51.100.1"},
+			},
+			expect: map[string]string{
+				"Host":              u.Host,
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Host":  "app.test",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=203.0.113.7;host=app.test;proto=http",
+			},
+		},
+		{
+			name:   "trusted proxy",
+			host:   "app.test",
+			remote: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Host":  {"www.app.test"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for=198.51.100.1;host=www.app.test;proto=https`},
+			},
+			expect: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1, 10.0.0.1",
+				"X-Forwarded-Host":  "www.app.test",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=198.51.100.1;host=www.app.test;proto=https, for=10.0.0.1;host=app.test;proto=http",
+			},
+		},
+		{
+			name:   "preserved host",
+			host:   "keep.test",
+			remote: "[2001:db8::1]:1234",
+			expect: map[string]string{
+				"Host":      "keep.test",
+				"Forwarded": `for="[2001:db8::1]";host=keep.test;proto=http`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		received = nil
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if received == nil {
+			t.Fatalf("%s: expected the request to reach the upstream, received %d", tt.name, rec.Code)
+		}
+
+		for k, v := range tt.expect {
+			actual := received.Header.Get(k)
+			if k == "Host" {
+				actual = received.Host
+			}
+			if actual != v {
+				t.Errorf("%s: expected %s %q, received %q", tt.name, k, v, actual)
+			}
+		}
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		{remote: "203.0.113.7:1234", forwarded: "for=198.51.100.1", expected: "203.0.113.7"},
+		{remote: "10.0.0.1:1234", forwarded: "for=198.51.100.1", expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwarded: `for=1.1.1.1, for="198.51.100.1:4711";proto=https, for=10.0.0.2`, expected: "198.51.100.1"},
+		{remote: "10.0.0.1:1234", forwarded: `for="[2001:db8::1]:4711"`, expected: "2001:db8::1"},
+		{remote: "10.0.0.1:1234", forwarded: `for="1.1.1.1,for=2.2.2.2", for=_hidden, for=10.0.0.2`, expected: "10.0.0.2"},
+		{remote: "10.0.0.1:1234", forwarded: "for=unknown", expected: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("Forwarded", tt.forwarded)
+
+		if ip := clientIP(req, trusted, headerForwarded); ip.String() != tt.expected {
+			t.Errorf("expected %s from %s %q, received %s", tt.expected, tt.remote, tt.forwarded, ip)
+		}
+	}
+}
+
+func TestClientIPIgnoresOtherHeader(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the proxy records the client in its header and passes
+	// whatever the client put in the other one through.
+	tests := []struct {
+		header   string
+		set      string
+		spoofed  string
+		value    string
+		expected string
+	}{
+		{"", "X-Forwarded-For", "Forwarded", "for=192.0.2.99", "198.51.100.1"},
+		{headerXForwardedFor, "X-Forwarded-For", "Forwarded", "for=192.0.2.99", "198.51.100.1"},
+		{headerForwarded, "Forwarded", "X-Forwarded-For", "192.0.2.99", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(tt.spoofed, tt.value)
+		if tt.set == headerForwarded {
+			req.Header.Set(tt.set, "for=198.51.100.1")
+		} else {
+			req.Header.Set(tt.set, "198.51.100.1")
+		}
+
+		if ip := clientIP(req, trusted, tt.header); ip.String() != tt.expected {
+			t.Errorf("expected %s reading %q with a spoofed %s, received %s", tt.expected, tt.header, tt.spoofed, ip)
+		}
+	}
+
+	cfg := Config{TrustedProxyHeader: "x-real-ip"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "unknown trusted proxy header") {
+		t.Errorf("expected an unknown trusted proxy header to be rejected, received %v", err)
+	}
+}
+
+func TestConsistentHashBehindProxy(t *testing.T) {
+	var upstreams []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer srv.Close()
+		upstreams = append(upstreams, srv.URL)
+	}
+
+	table, err := newRouteTable(Routes{{
+		Host:      "sticky.test",
+		Upstreams: []Upstream{{URL: upstreams[0]}, {URL: upstreams[1]}},
+		Balancer:  &BalancerConfig{Type: ConsistentHash},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+	h.trusted, _ = parseCIDRs([]string{"10.0.0.0/8"})
+
+	get := func(client string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://sticky.test/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	picked := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		client := "203.0.113." + strconv.Itoa(i)
+		first := get(client)
+		if again := get(client); again != first {
+			t.Errorf("expected %s to stick to upstream %s, moved to %s", client, first, again)
+		}
+		picked[first] = true
+	}
+
+	if !picked["a"] || !picked["b"] {
+		t.Errorf("expected clients behind the proxy to be spread over both upstreams, picked %v", picked)
+	}
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// Protocols spoken to a route's upstreams.
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+)
+
+// gRPC status codes sent when an upstream can't be reached.
+const (
+	grpcDeadlineExceeded = 4
+	grpcUnavailable      = 14
+)
+
+// grpcHealthMethod is the method of the standard gRPC health service.
+const grpcHealthMethod = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the status of a healthy service.
+const grpcServing = 1
+
+// maxGRPCHealthResponse bounds the health check responses read.
+const maxGRPCHealthResponse = 4096
+
+// checkProtocol checks that a route's upstreams can be
+// reached with its protocol and health check.
+func checkProtocol(r Route, backends []*Backend) error {
+	var scheme string
+	switch r.Protocol {
+	case "", ProtocolHTTP1:
+		if r.HealthCheck != nil && r.HealthCheck.Type == "grpc" {
+			return errors.New("gRPC health checks need the h2 or h2c protocol")
+		}
+		return nil
+	case ProtocolH2:
+		scheme = "https"
+	case ProtocolH2C:
+		scheme = "http"
+	default:
+		return errors.Errorf("unknown upstream protocol: %s", r.Protocol)
+	}
+
+	for _, b := range backends {
+		if b.URL.Scheme != scheme {
+			return errors.Errorf("%s upstreams must be %s URLs: %s", r.Protocol, scheme, b.URL)
+		}
+	}
+
+	return nil
+}
+
+// newBaseTransport returns the transport that sends a route's
+// requests to its upstreams in the route's protocol.
+func newBaseTransport(r *route, tlsConfig *tls.Config) http.RoundTripper {
+	dial := dialer(time.Duration(r.timeouts.Connect))
+
+	switch r.Protocol {
+	case ProtocolH2:
+		return &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(context.Background(), network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return handshakeH2(conn, cfg, time.Duration(r.timeouts.TLSHandshake))
+			},
+		}
+	case ProtocolH2C:
+		// h2c is HTTP/2 with prior knowledge, without TLS.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		}
+	}
+
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dial,
+		TLSHandshakeTimeout: time.Duration(r.timeouts.TLSHandshake),
+		TLSClientConfig:     tlsConfig,
+	}
+}
+
+// handshakeH2 secures an upstream connection and
+// checks that the upstream agreed to HTTP/2.
+func handshakeH2(conn net.Conn, cfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, cfg)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &upstreamTimeout{kind: timeoutTLSHandshake, err: err}
+		}
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, errors.Errorf("upstream negotiated %q instead of HTTP/2", p)
+	}
+
+	return tlsConn, nil
+}
+
+// isGRPC reports whether the request is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcError answers a gRPC call with a trailers-only response
+// carrying the status, which gRPC clients read in place of the
+// HTTP status.
+func grpcError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatus returns the status and message of a gRPC response, from
+// its trailers or, for trailers-only responses, its headers. Trailers
+// are only read once the body has been consumed.
+func grpcStatus(res *http.Response) (string, string) {
+	if status := res.Trailer.Get("Grpc-Status"); status != "" {
+		return status, res.Trailer.Get("Grpc-Message")
+	}
+
+	return res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+}
+
+// checkGRPC calls the standard gRPC health service of an
+// upstream and requires it to report the service as serving.
+func (c *healthChecker) checkGRPC(ctx context.Context, b *Backend) error {
+	target := *b.URL
+	target.Path = singleJoiningSlash(b.URL.Path, grpcHealthMethod)
+	target.RawPath = ""
+
+	var msg protoBuffer
+	if c.cfg.Service != "" {
+		msg.string(1, c.cfg.Service)
+	}
+	body := make([]byte, 5+len(msg.b))
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(msg.b)))
+	copy(body[5:], msg.b)
+
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "butler-health-check")
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxGRPCHealthResponse))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	if status, msg := grpcStatus(res); status != "0" {
+		return errors.Errorf("unexpected gRPC status %s: %s", status, msg)
+	}
+
+	if len(data) < 5 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		return errors.New("malformed gRPC health response")
+	}
+	if data[0] != 0 {
+		return errors.New("compressed gRPC health response")
+	}
+
+	status, err := servingStatus(data[5:])
+	if err != nil {
+		return err
+	}
+	if status != grpcServing {
+		return errors.Errorf("service is not serving: status %d", status)
+	}
+
+	return nil
+}
+
+// servingStatus decodes the status of a HealthCheckResponse.
+func servingStatus(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed gRPC health response")
+		}
+		msg = msg[n:]
+
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			msg = msg[n:]
+			if key>>3 == 1 {
+				status = v
+			}
+		case wireBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			msg = msg[n+int(l):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if key&7 == wireFixed32 {
+				size = 4
+			}
+			if len(msg) < size {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			msg = msg[size:]
+		default:
+			return 0, errors.New("malformed gRPC health response")
+		}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cServer serves handler over HTTP/2 with prior knowledge.
+func h2cServer(t *testing.T, handler http.Handler) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http2.Server{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	return "http://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+// grpcFrame prefixes a message with its gRPC framing.
+func grpcFrame(msg []byte) []byte {
+	framed := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(framed[1:5], uint32(len(msg)))
+	copy(framed[5:], msg)
+	return framed
+}
+
+func TestGRPCProxy(t *testing.T) {
+	release := make(chan struct{})
+	upstream, closeUpstream := h2cServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2, received %s", r.Proto)
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("second"))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	defer closeUpstream()
+
+	tlsUpstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2 over TLS, received %s", r.Proto)
+		}
+	}))
+	tlsUpstream.EnableHTTP2 = true
+	tlsUpstream.StartTLS()
+	defer tlsUpstream.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "http://" + ln.Addr().String()
+	ln.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "grpc.test", Target: upstream, Protocol: ProtocolH2C, Timeouts: &Timeouts{ResponseHeader: Duration(50 * time.Millisecond)}},
+		{Host: "tls.test", Target: tlsUpstream.URL, Protocol: ProtocolH2, UpstreamTLS: &UpstreamTLS{InsecureSkipVerify: true}},
+		{Host: "dead.test", Target: dead, Protocol: ProtocolH2C},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	call := func(host, path string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewReader(grpcFrame(nil)))
+		req.Host = host
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to call %s: %v", host, err)
+		}
+		return res
+	}
+
+	res := call("grpc.test", "/")
+	first := make([]byte, 5)
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "first" {
+		t.Fatalf("expected the first message before the stream ended, received %q: %v", first, err)
+	}
+	close(release)
+	rest, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(rest) != "second" {
+		t.Errorf("expected the rest of the stream, received %q", rest)
+	}
+	if status := res.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("expected the upstream's trailers, received %v", res.Trailer)
+	}
+
+	res = call("tls.test", "/")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the h2 upstream to answer, received %d", res.StatusCode)
+	}
+
+	tests := []struct {
+		host, path string
+		status     string
+		message    string
+	}{
+		{"dead.test", "/", "14", "upstream unavailable"},
+		{"grpc.test", "/slow", "4", "response header timeout"},
+	}
+
+	for _, tt := range tests {
+		res := call(tt.host, tt.path)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || res.Header.Get("Grpc-Status") != tt.status || res.Header.Get("Grpc-Message") != tt.message {
+			t.Errorf("expected gRPC status %s %q from %s, received %d with %v", tt.status, tt.message, tt.host, res.StatusCode, res.Header)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://dead.test/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected other requests to receive a 502, received %d", rec.Code)
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	var notServing int32
+	upstream, closeUpstream := h2cServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != grpcHealthMethod || !bytes.Contains(body, []byte("echo")) {
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+
+		status := uint64(grpcServing)
+		if atomic.LoadInt32(&notServing) == 1 {
+			status = 2
+		}
+
+		var msg protoBuffer
+		msg.uint(1, status)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcFrame(msg.b))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	defer closeUpstream()
+
+	r, err := compileRoute(Route{
+		Host:     "grpc.test",
+		Target:   upstream,
+		Protocol: ProtocolH2C,
+		HealthCheck: &HealthCheck{
+			Type:     "grpc",
+			Service:  "echo",
+			Interval: Duration(10 * time.Millisecond),
+			Rise:     1,
+			Fall:     1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile route: %v", err)
+	}
+
+	r.start(nil, nil)
+	defer r.close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	atomic.StoreInt32(&notServing, 1)
+	waitFor(t, "a service that isn't serving to be taken out of rotation", func() bool {
+		return r.pick(req) == nil
+	})
+
+	atomic.StoreInt32(&notServing, 0)
+	waitFor(t, "a serving service to be restored", func() bool {
+		return r.pick(req) != nil
+	})
+}
+
+func TestProtocolConfig(t *testing.T) {
+	tests := []struct {
+		route Route
+		err   string
+	}{
+		{Route{Host: "a", Target: "http://10.0.0.1", Protocol: ProtocolH2C}, ""},
+		{Route{Host: "a", Target: "https://10.0.0.1", Protocol: ProtocolH2}, ""},
+		{Route{Host: "a", Target: "https://10.0.0.1", Protocol: ProtocolH2C}, "must be http URLs"},
+		{Route{Host: "a", Target: "http://10.0.0.1", Protocol: ProtocolH2}, "must be https URLs"},
+		{Route{Host: "a", Target: "http://10.0.0.1", Protocol: "spdy"}, "unknown upstream protocol"},
+		{Route{Host: "a", Target: "http://10.0.0.1", HealthCheck: &HealthCheck{Type: "grpc"}}, "need the h2 or h2c protocol"},
+	}
+
+	for _, tt := range tests {
+		err := tt.route.Validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("expected %+v to be valid, received %v", tt.route, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("expected %+v to be rejected with %q, received %v", tt.route, tt.err, err)
+		}
+	}
+
+	for _, msg := range [][]byte{{0x08}, {0x0a, 0x05}, {0x0f}} {
+		if _, err := servingStatus(msg); err == nil {
+			t.Errorf("expected %x to be rejected", msg)
+		}
+	}
+}
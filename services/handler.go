@@ -2,38 +2,175 @@ package services
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/logging"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
 )
 
 type handler struct {
 	EnforceSSL bool
-	targets    map[string]string
-	logger     *logging.Logger
-	proxies    map[string]*httputil.ReverseProxy
+	routes     atomic.Value
+	logger     Logger
+	accessLog  accessLogger
+	certs      *certStore
+	format     propagation.HTTPFormat
 	projectID  string
 	l          sync.Mutex
+
+	// readinessPath is answered on every host, failing once
+	// draining has begun.
+	readinessPath string
+	draining      int32
+	conns         connTracker
+
+	runtime runtimeState
+
+	// trusted holds the proxies whose forwarding headers are believed,
+	// proxyHeader the one they record clients in and access the
+	// addresses allowed to reach any route.
+	trusted     cidrList
+	proxyHeader string
+	access      *accessList
+}
+
+// table returns the route table currently in effect.
+func (h *handler) table() *routeTable {
+	t, _ := h.routes.Load().(*routeTable)
+	if t == nil {
+		return &routeTable{}
+	}
+
+	return t
+}
+
+// setTable swaps in a new route table, starts health checks for new
+// routes and shuts down any route that was replaced. Requests already
+// in flight keep using the table and proxy they started with.
+func (h *handler) setTable(next *routeTable) []string {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	prev := h.table()
+	changed := prev.changed(next)
+
+	for key, r := range next.keys {
+		if prev.keys[key] != r {
+			r.logger = h.logger
+			r.start(h.healthChanged, h.upstreamChanged)
+		}
+	}
+
+	h.routes.Store(next)
+
+	for key, r := range prev.keys {
+		if next.keys[key] != r {
+			r.close()
+		}
+	}
+
+	return changed
+}
+
+func (h *handler) healthChanged(route string, b *Backend, healthy bool, err error) {
+	entry := logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Info,
+		Labels: map[string]string{
+			"route":    route,
+			"upstream": b.URL.String(),
+		},
+		Payload: "Upstream is healthy",
+	}
+
+	if !healthy {
+		entry.Severity = logging.Warning
+		entry.Payload = "Upstream is unhealthy: " + err.Error()
+	}
+
+	h.logger.Log(entry)
+}
+
+func (h *handler) upstreamChanged(route string, b *Backend, event, reason string) {
+	severity := logging.Info
+	if event == eventCircuitOpened || event == eventEjected {
+		severity = logging.Warning
+	}
+
+	h.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  severity,
+		Labels: map[string]string{
+			"route":    route,
+			"upstream": b.URL.String(),
+		},
+		Payload: event + ": " + reason,
+	})
 }
 
 type request struct {
 	entry    logging.Entry
 	span     *trace.Span
+	format   propagation.HTTPFormat
 	response http.ResponseWriter
 	request  *http.Request
+
+	// original is the request as received from the client and
+	// recorder captures what was sent back, for the access log.
+	original *http.Request
+	recorder *responseRecorder
+	start    time.Time
+	clientIP net.IP
+
+	// route and upstream are filled in as the request is
+	// routed and forwarded.
+	route           string
+	upstream        string
+	upstreamLatency time.Duration
+}
+
+type requestKey struct{}
+
+// requestFrom returns the request state stored in ctx by ServeHTTP.
+func requestFrom(ctx context.Context) *request {
+	r, _ := ctx.Value(requestKey{}).(*request)
+	return r
+}
+
+// propagation returns the trace header formats read from
+// clients and written to upstreams.
+func (h *handler) propagation() propagation.HTTPFormat {
+	if h.format == nil {
+		return multiFormat{traceContextFormat{}, &b3.HTTPFormat{}}
+	}
+
+	return h.format
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, span := trace.StartSpan(context.Background(), "butler")
+	if h.readinessPath != "" && r.URL.Path == h.readinessPath {
+		h.ready(w)
+		return
+	}
+
+	// continue the trace started by the server middleware or,
+	// failing that, the one the client sent us.
+	var span *trace.Span
+	if parent, ok := h.propagation().SpanContextFromRequest(r); ok && trace.FromContext(r.Context()) == nil {
+		_, span = trace.StartSpanWithRemoteParent(r.Context(), "butler", parent, trace.WithSpanKind(trace.SpanKindServer))
+	} else {
+		_, span = trace.StartSpan(r.Context(), "butler")
+	}
 	defer span.End()
 
 	span.AddAttributes(trace.StringAttribute("http.host", r.Host))
@@ -43,78 +180,148 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	span.AddAttributes(trace.StringAttribute("http.user_agent", r.UserAgent()))
 	span.AddAttributes(trace.StringAttribute("http.url", r.URL.String()))
 
+	recorder := &responseRecorder{ResponseWriter: w, conns: &h.conns}
 	req := &request{
-		request:  r.WithContext(trace.NewContext(r.Context(), span)),
-		response: w,
+		response: recorder,
 		span:     span,
+		format:   h.propagation(),
+		original: r,
+		recorder: recorder,
+		start:    time.Now().UTC(),
+		clientIP: clientIP(r, h.trusted, h.proxyHeader),
 		entry: logging.Entry{
 			Timestamp: time.Now().UTC(),
 			Severity:  logging.Info,
 			Labels:    map[string]string{},
-			HTTPRequest: &logging.HTTPRequest{
-				Request: r,
-				Status:  http.StatusTemporaryRedirect,
-			},
-			Payload: "Handling HTTP Request",
-			Trace:   fmt.Sprintf("projects/%s/traces/%s", h.projectID, span.SpanContext().TraceID),
+			Trace:     fmt.Sprintf("projects/%s/traces/%s", h.projectID, span.SpanContext().TraceID),
 		},
 	}
-	h.logger.Log(req.entry)
 
-	h.forceSSL(req)
+	ctx := trace.NewContext(r.Context(), span)
+	req.request = r.WithContext(context.WithValue(ctx, requestKey{}, req))
+
+	// the access log and metrics are written once the response is
+	// complete so they reflect what the client actually received.
+	defer h.finish(req)
+
+	if h.access != nil {
+		if err := h.access.check(req.clientIP); err != nil {
+			h.denied(req, err)
+			return
+		}
+	}
+
+	if h.forceSSL(req) {
+		return
+	}
+
+	// "/public/../admin" must not match "/public/*" and reach the
+	// upstream as "/admin", passing the checks of its own route.
+	if cleaned := cleanPath(req.request.URL.Path); cleaned != req.request.URL.Path {
+		u := *req.request.URL
+		u.Path, u.RawPath = cleaned, ""
+		req.request.URL = &u
+	}
 
-	host := req.request.Host
-	target, ok := h.targets[host]
+	m, ok := h.table().lookup(req.request.Host, req.request.URL.Path)
 	if !ok {
 		h.notFound(req)
 		return
 	}
 
-	remote, err := url.Parse(target)
-	if err != nil {
-		req.entry.Payload = err
-		req.entry.Severity = logging.Error
-		h.logger.Log(req.entry)
-		return
+	if m.access != nil {
+		if err := m.access.check(req.clientIP); err != nil {
+			req.route = m.key
+			h.denied(req, err)
+			return
+		}
+	}
+
+	stripClientCertHeaders(req.request.Header)
+	if m.client != nil {
+		leaf, err := m.client.verify(req.request.TLS)
+		if err != nil {
+			req.route = m.key
+			h.forbidden(req, err)
+			return
+		}
+		m.client.forwardHeaders(req.request.Header, leaf)
 	}
 
-	req.request.Host = remote.Host
+	h.setForwarded(req)
 
-	if fn, ok := h.proxies[host]; ok {
-		req.entry.Payload = "Redirecting to Service"
-		req.entry.Labels["service"] = host
-		fn.ServeHTTP(req.response, req.request)
+	if m.limiter != nil && !h.rateLimit(req, m.limiter) {
+		req.route = m.key
 		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(remote)
-	proxy.Transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+	forward := *req.request.URL
+	forward.Path = m.forwardPath(forward.Path)
+	if forward.Path != req.request.URL.Path {
+		forward.RawPath = ""
 	}
 
-	h.l.Lock()
-	switch h.proxies {
-	case nil:
-		h.proxies = map[string]*httputil.ReverseProxy{
-			host: proxy,
+	proxyCtx := context.WithValue(req.request.Context(), paramsKey{}, m.params)
+	if timeout := time.Duration(m.timeouts.Request); timeout > 0 {
+		var cancel context.CancelFunc
+		proxyCtx, cancel = context.WithTimeout(proxyCtx, timeout)
+		defer cancel()
+	}
+
+	req.request = req.request.WithContext(proxyCtx)
+	req.request.URL = &forward
+
+	req.route = m.key
+	req.entry.Labels["service"] = m.key
+
+	if isUpgrade(req.request) {
+		done, ok := h.startUpgrade(req, m.route)
+		if !ok {
+			return
 		}
-	default:
-		h.proxies[host] = proxy
+		defer done()
+	}
+
+	routeTag := []tag.Mutator{tag.Upsert(keyRoute, m.key)}
+	record(ctx, routeTag, inFlight.M(atomic.AddInt64(&m.inFlight, 1)))
+	defer func() {
+		record(ctx, routeTag, inFlight.M(atomic.AddInt64(&m.inFlight, -1)))
+	}()
+
+	m.proxy.ServeHTTP(req.response, req.request)
+}
+
+// finish writes the access log entry and records
+// the metrics for a completed request.
+func (h *handler) finish(req *request) {
+	e := newAccessLogEntry(req)
+	if h.accessLog != nil {
+		h.accessLog.log(e, req)
 	}
-	h.l.Unlock()
 
-	proxy.ServeHTTP(req.response, req.request)
+	route, upstream := e.Route, e.Upstream
+	if route == "" {
+		route = "unmatched"
+	}
+	if upstream == "" {
+		upstream = "none"
+	}
+
+	record(context.Background(), []tag.Mutator{
+		tag.Upsert(keyRoute, route),
+		tag.Upsert(keyUpstream, upstream),
+		tag.Upsert(keyCode, strconv.Itoa(e.Status)),
+	}, requests.M(1))
+	record(context.Background(), []tag.Mutator{
+		tag.Upsert(keyRoute, route),
+	}, requestLatency.M(e.Latency.Seconds()))
 }
 
-func (h *handler) forceSSL(r *request) {
+// forceSSL redirects plain HTTP requests to HTTPS when SSL is
+// enforced and reports whether it did.
+func (h *handler) forceSSL(r *request) bool {
 	if !h.EnforceSSL || r.request.TLS != nil {
-		return
+		return false
 	}
 
 	r.entry.Payload = "Redirecting to HTTP(s)"
@@ -130,6 +337,29 @@ func (h *handler) forceSSL(r *request) {
 		redirect,
 		http.StatusTemporaryRedirect,
 	)
+
+	return true
+}
+
+// forbidden rejects a request that failed client authentication.
+func (h *handler) forbidden(r *request, err error) {
+	h.reject(r, "Rejected client: ", err)
+}
+
+// denied rejects a request from an address an access list doesn't allow.
+func (h *handler) denied(r *request, err error) {
+	h.reject(r, "Denied by access list: ", err)
+}
+
+func (h *handler) reject(r *request, reason string, err error) {
+	r.span.SetStatus(trace.Status{Code: trace.StatusCodePermissionDenied, Message: err.Error()})
+
+	r.entry.Severity = logging.Warning
+	r.entry.Labels["service"] = r.route
+	r.entry.Payload = reason + err.Error()
+	h.logger.Log(r.entry)
+
+	http.Error(r.response, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 }
 
 func (h *handler) notFound(r *request) error {
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthRise     = 2
+	defaultHealthFall     = 3
+	defaultExpectStatus   = "200-399"
+)
+
+// HealthCheck configures active health checking of a route's
+// upstreams. An upstream is taken out of rotation after Fall
+// consecutive failed checks and put back after Rise consecutive
+// successful ones.
+type HealthCheck struct {
+	// Type is "http" (the default), "tcp" or "grpc".
+	Type string `json:"type,omitempty"`
+	// Path is requested from each upstream by HTTP checks.
+	Path string `json:"path,omitempty"`
+	// Service is the name gRPC checks ask the health service
+	// about; empty asks about the server as a whole.
+	Service string `json:"service,omitempty"`
+	// ExpectStatus is the inclusive range of status codes, such
+	// as "200-299" or "204", that HTTP checks accept.
+	ExpectStatus string   `json:"expectStatus,omitempty"`
+	Interval     Duration `json:"interval,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+	Rise         int      `json:"rise,omitempty"`
+	Fall         int      `json:"fall,omitempty"`
+}
+
+// Healthy reports whether the backend is passing its health checks.
+// Backends of routes without health checks are always healthy.
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+func (b *Backend) setHealthy(healthy bool) bool {
+	if healthy {
+		return atomic.CompareAndSwapInt32(&b.unhealthy, 1, 0)
+	}
+
+	return atomic.CompareAndSwapInt32(&b.unhealthy, 0, 1)
+}
+
+type healthChecker struct {
+	cfg      HealthCheck
+	lo, hi   int
+	route    string
+	client   *http.Client
+	onChange func(route string, b *Backend, healthy bool, err error)
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHealthChecker(route string, cfg HealthCheck, transport http.RoundTripper) (*healthChecker, error) {
+	switch cfg.Type {
+	case "":
+		cfg.Type = "http"
+	case "http", "tcp", "grpc":
+	default:
+		return nil, errors.Errorf("unknown health check type: %s", cfg.Type)
+	}
+
+	if cfg.ExpectStatus == "" {
+		cfg.ExpectStatus = defaultExpectStatus
+	}
+	lo, hi, err := parseStatusRange(cfg.ExpectStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = Duration(defaultHealthInterval)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Duration(defaultHealthTimeout)
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = defaultHealthRise
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = defaultHealthFall
+	}
+
+	return &healthChecker{
+		cfg:   cfg,
+		lo:    lo,
+		hi:    hi,
+		route: route,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(cfg.Timeout),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		stop: make(chan struct{}),
+	}, nil
+}
+
+func parseStatusRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid status range: %s", s)
+	}
+
+	hi := lo
+	if len(parts) == 2 {
+		hi, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return 0, 0, errors.Errorf("invalid status range: %s", s)
+		}
+	}
+
+	if lo < 100 || hi > 599 || lo > hi {
+		return 0, 0, errors.Errorf("invalid status range: %s", s)
+	}
+
+	return lo, hi, nil
+}
+
+// start checks each backend on its own schedule until close is called.
+func (c *healthChecker) start(backends []*Backend) {
+	for _, b := range backends {
+		c.wg.Add(1)
+		go c.run(b)
+	}
+}
+
+func (c *healthChecker) close() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+func (c *healthChecker) run(b *Backend) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(c.cfg.Interval))
+	defer ticker.Stop()
+
+	mutators := []tag.Mutator{
+		tag.Upsert(keyRoute, c.route),
+		tag.Upsert(keyUpstream, b.URL.Host),
+	}
+
+	passed, failed := 0, 0
+	for {
+		if b.State() == UpstreamDisabled {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				continue
+			}
+		}
+
+		err := c.check(b)
+
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		record(context.Background(), append(mutators, tag.Upsert(keyResult, result)), healthChecks.M(1))
+
+		switch {
+		case err == nil:
+			passed, failed = passed+1, 0
+			if passed >= c.cfg.Rise && b.setHealthy(true) && c.onChange != nil {
+				c.onChange(c.route, b, true, nil)
+			}
+		default:
+			passed, failed = 0, failed+1
+			if failed >= c.cfg.Fall && b.setHealthy(false) && c.onChange != nil {
+				c.onChange(c.route, b, false, err)
+			}
+		}
+
+		healthy := int64(0)
+		if b.Healthy() {
+			healthy = 1
+		}
+		record(context.Background(), mutators, upstreamHealthy.M(healthy))
+
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *healthChecker) check(b *Backend) error {
+	if c.cfg.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", hostPort(b.URL.Scheme, b.URL.Host), time.Duration(c.cfg.Timeout))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if c.cfg.Type == "grpc" {
+		return c.checkGRPC(ctx, b)
+	}
+
+	target := *b.URL
+	target.Path = singleJoiningSlash(b.URL.Path, c.cfg.Path)
+	target.RawPath = ""
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "butler-health-check")
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+
+	if res.StatusCode < c.lo || res.StatusCode > c.hi {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// hostPort adds the default port for the scheme when host has none.
+func hostPort(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	if scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+
+	return net.JoinHostPort(host, "80")
+}
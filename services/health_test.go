@@ -0,0 +1,97 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	r, err := compileRoute(Route{
+		Host:   "butler-proxy",
+		Target: srv.URL,
+		HealthCheck: &HealthCheck{
+			Path:     "/healthz",
+			Interval: Duration(10 * time.Millisecond),
+			Rise:     2,
+			Fall:     1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile route: %v", err)
+	}
+
+	changes := make(chan bool, 10)
+	r.start(func(route string, b *Backend, healthy bool, err error) {
+		changes <- healthy
+	}, nil)
+	defer r.close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if r.pick(req) == nil {
+		t.Fatal("expected backend to start in rotation")
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	waitFor(t, "backend to be marked unhealthy", func() bool {
+		return r.pick(req) == nil
+	})
+
+	atomic.StoreInt32(&failing, 0)
+	waitFor(t, "backend to be restored", func() bool {
+		return r.pick(req) != nil
+	})
+
+	if down, up := <-changes, <-changes; down || !up {
+		t.Errorf("expected an unhealthy then healthy transition, received %v then %v", down, up)
+	}
+}
+
+func TestHealthCheckConfig(t *testing.T) {
+	tests := []struct {
+		cfg   HealthCheck
+		valid bool
+	}{
+		{cfg: HealthCheck{}, valid: true},
+		{cfg: HealthCheck{Type: "tcp"}, valid: true},
+		{cfg: HealthCheck{ExpectStatus: "204"}, valid: true},
+		{cfg: HealthCheck{Type: "udp"}},
+		{cfg: HealthCheck{ExpectStatus: "500-200"}},
+		{cfg: HealthCheck{ExpectStatus: "ok"}},
+	}
+
+	for _, tc := range tests {
+		_, err := newHealthChecker("test", tc.cfg, http.DefaultTransport)
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
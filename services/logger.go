@@ -0,0 +1,332 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+)
+
+// Logging backends understood by LogConfig.Backend.
+const (
+	LogText        = "text"
+	LogJSON        = "json"
+	LogFile        = "file"
+	LogStackdriver = "stackdriver"
+)
+
+const (
+	defaultLogMaxSizeMB  = 100
+	defaultLogMaxBackups = 5
+)
+
+// Logger writes log entries. Implementations must be safe for
+// concurrent use. *logging.Logger from cloud.google.com/go/logging
+// satisfies it.
+type Logger interface {
+	Log(e logging.Entry)
+	Flush() error
+}
+
+// LogConfig selects where butler writes its logs.
+type LogConfig struct {
+	// Backend is one of text, json, file or stackdriver. When empty,
+	// stackdriver is used if PROJECT_ID is set and text otherwise.
+	Backend string `json:"backend,omitempty"`
+
+	// File, Format, MaxSizeMB and MaxBackups configure the file
+	// backend. Format is text or json (the default).
+	File       string `json:"file,omitempty"`
+	Format     string `json:"format,omitempty"`
+	MaxSizeMB  int    `json:"maxSizeMB,omitempty"`
+	MaxBackups int    `json:"maxBackups,omitempty"`
+}
+
+// NewLogger creates the logger described by cfg.
+func NewLogger(cfg *LogConfig, projectID string) (Logger, error) {
+	if cfg == nil {
+		cfg = &LogConfig{}
+	}
+
+	backend := cfg.Backend
+	if backend == "" {
+		backend = LogText
+		if projectID != "" {
+			backend = LogStackdriver
+		}
+	}
+
+	switch backend {
+	case LogText:
+		return NewTextLogger(os.Stdout), nil
+	case LogJSON:
+		return NewJSONLogger(os.Stdout), nil
+	case LogFile:
+		return newFileLogger(cfg)
+	case LogStackdriver:
+		if projectID == "" {
+			return nil, errors.New("PROJECT_ID is required for the stackdriver logging backend")
+		}
+
+		client, err := logging.NewClient(context.Background(), projectID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create client")
+		}
+
+		return client.Logger(logName), nil
+	default:
+		return nil, errors.Errorf("unknown logging backend: %s", backend)
+	}
+}
+
+// NewTextLogger returns a Logger that writes one
+// human readable line per entry to w.
+func NewTextLogger(w io.Writer) Logger {
+	return &streamLogger{w: w, format: formatText}
+}
+
+// NewJSONLogger returns a Logger that writes one
+// JSON object per entry to w.
+func NewJSONLogger(w io.Writer) Logger {
+	return &streamLogger{w: w, format: formatJSON}
+}
+
+type streamLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(e logging.Entry) []byte
+}
+
+func (l *streamLogger) Log(e logging.Entry) {
+	line := l.format(e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w.Write(line)
+}
+
+func (l *streamLogger) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.w.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+
+	return nil
+}
+
+func timestamp(e logging.Entry) time.Time {
+	if e.Timestamp.IsZero() {
+		return time.Now().UTC()
+	}
+
+	return e.Timestamp
+}
+
+func payload(e logging.Entry) interface{} {
+	switch p := e.Payload.(type) {
+	case error:
+		return p.Error()
+	case fmt.Stringer:
+		return p.String()
+	default:
+		return p
+	}
+}
+
+func formatText(e logging.Entry) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %-7s %v", timestamp(e).Format(time.RFC3339), e.Severity, payload(e))
+
+	if r := e.HTTPRequest; r != nil && r.Request != nil {
+		fmt.Fprintf(&b, " method=%s host=%s url=%q", r.Request.Method, r.Request.Host, r.Request.URL)
+		if r.Status != 0 {
+			fmt.Fprintf(&b, " status=%d", r.Status)
+		}
+	}
+
+	keys := make([]string, 0, len(e.Labels))
+	for k := range e.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, e.Labels[k])
+	}
+
+	if e.Trace != "" {
+		fmt.Fprintf(&b, " trace=%s", e.Trace)
+	}
+
+	b.WriteByte('\n')
+
+	return []byte(b.String())
+}
+
+type jsonHTTPRequest struct {
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	Host      string `json:"host"`
+	RemoteIP  string `json:"remoteIp,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Size      int64  `json:"responseSize,omitempty"`
+	Latency   string `json:"latency,omitempty"`
+}
+
+type jsonEntry struct {
+	Timestamp   time.Time         `json:"timestamp"`
+	Severity    string            `json:"severity"`
+	Payload     interface{}       `json:"message"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	HTTPRequest *jsonHTTPRequest  `json:"httpRequest,omitempty"`
+	Trace       string            `json:"trace,omitempty"`
+}
+
+func formatJSON(e logging.Entry) []byte {
+	entry := jsonEntry{
+		Timestamp: timestamp(e),
+		Severity:  e.Severity.String(),
+		Payload:   payload(e),
+		Labels:    e.Labels,
+		Trace:     e.Trace,
+	}
+
+	if r := e.HTTPRequest; r != nil && r.Request != nil {
+		entry.HTTPRequest = &jsonHTTPRequest{
+			Method:    r.Request.Method,
+			URL:       r.Request.URL.String(),
+			Host:      r.Request.Host,
+			RemoteIP:  r.RemoteIP,
+			UserAgent: r.Request.UserAgent(),
+			Status:    r.Status,
+			Size:      r.ResponseSize,
+		}
+		if r.Latency > 0 {
+			entry.HTTPRequest.Latency = r.Latency.String()
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		entry.Payload = fmt.Sprint(entry.Payload)
+		data, _ = json.Marshal(entry)
+	}
+
+	return append(data, '\n')
+}
+
+// rotatingFile is an io.Writer over a file that is rotated to
+// file.1, file.2, ... once it grows past maxSize bytes.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func newFileLogger(cfg *LogConfig) (Logger, error) {
+	if cfg.File == "" {
+		return nil, errors.New("file is required for the file logging backend")
+	}
+
+	rf, err := newRotatingFile(cfg.File, cfg.MaxSizeMB, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Format {
+	case "", LogJSON:
+		return NewJSONLogger(rf), nil
+	case LogText:
+		return NewTextLogger(rf), nil
+	default:
+		return nil, errors.Errorf("unknown log file format: %s", cfg.Format)
+	}
+}
+
+func newRotatingFile(path string, maxSizeMB, maxBackups int) (*rotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultLogMaxSizeMB
+	}
+
+	if maxBackups <= 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open log file")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to stat log file")
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+
+	return nil
+}
+
+// Write is not safe for concurrent use, callers serialize writes.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+func (rf *rotatingFile) Sync() error {
+	return rf.f.Sync()
+}
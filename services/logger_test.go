@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/logging"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf)
+	l.Log(logging.Entry{
+		Severity: logging.Warning,
+		Payload:  "hello",
+		Labels:   map[string]string{"route": "a/*"},
+		HTTPRequest: &logging.HTTPRequest{
+			Request: httptest.NewRequest("GET", "http://butler-proxy/path", nil),
+			Status:  200,
+		},
+	})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log line %q: %v", buf.String(), err)
+	}
+
+	if entry["severity"] != "Warning" || entry["message"] != "hello" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+
+	req, _ := entry["httpRequest"].(map[string]interface{})
+	if req["host"] != "butler-proxy" || req["status"] != float64(200) {
+		t.Errorf("unexpected httpRequest: %v", req)
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	NewTextLogger(&buf).Log(logging.Entry{
+		Severity: logging.Info,
+		Payload:  "Reloaded configuration",
+		Labels:   map[string]string{"reason": "SIGHUP"},
+	})
+
+	line := buf.String()
+	if !strings.Contains(line, "Info") || !strings.Contains(line, "Reloaded configuration") || !strings.Contains(line, `reason="SIGHUP"`) {
+		t.Errorf("unexpected log line: %q", line)
+	}
+}
+
+func TestFileLoggerRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "butler.log")
+	l, err := NewLogger(&LogConfig{Backend: LogFile, File: file, MaxBackups: 2}, "")
+	if err != nil {
+		t.Fatalf("failed to create file logger: %v", err)
+	}
+
+	// shrink the limit so a few entries force rotation.
+	l.(*streamLogger).w.(*rotatingFile).maxSize = 100
+	for i := 0; i < 10; i++ {
+		l.Log(logging.Entry{Payload: strings.Repeat("x", 60)})
+	}
+
+	for _, name := range []string{"butler.log", "butler.log.1", "butler.log.2"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "butler.log.3")); err == nil {
+		t.Error("expected at most 2 backups")
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	if _, err := NewLogger(&LogConfig{Backend: LogStackdriver}, ""); err == nil {
+		t.Error("expected stackdriver without a project to be rejected")
+	}
+
+	if _, err := NewLogger(&LogConfig{Backend: "syslog"}, ""); err == nil {
+		t.Error("expected unknown backend to be rejected")
+	}
+
+	if _, err := NewLogger(nil, ""); err != nil {
+		t.Errorf("expected default logger, received %v", err)
+	}
+}
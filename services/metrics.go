@@ -0,0 +1,192 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"go.opencensus.io/stats/view"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// MetricsConfig enables a listener serving butler's views
+// in the Prometheus text exposition format.
+type MetricsConfig struct {
+	ListenAddress string `json:"listenAddress"`
+	Path          string `json:"path,omitempty"`
+}
+
+func (c *MetricsConfig) path() string {
+	if c.Path == "" {
+		return defaultMetricsPath
+	}
+
+	return c.Path
+}
+
+// prometheusHandler renders the current data of views on every scrape.
+type prometheusHandler struct {
+	views []*view.View
+}
+
+func (p *prometheusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, v := range p.views {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			continue
+		}
+		writeView(&buf, v, rows)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(row *view.Row, extra ...string) string {
+	pairs := make([]string, 0, len(row.Tags)+len(extra)/2)
+	for _, t := range row.Tags {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, metricName(t.Key.Name()), labelEscaper.Replace(t.Value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func writeView(w io.Writer, v *view.View, rows []*view.Row) {
+	name := metricName(v.Name)
+
+	// keep the output stable between scrapes.
+	sort.Slice(rows, func(i, j int) bool {
+		return formatLabels(rows[i]) < formatLabels(rows[j])
+	})
+
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		name += "_total"
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, v.Description, name)
+	case view.AggTypeSum:
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, v.Description, name)
+	case view.AggTypeLastValue:
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, v.Description, name)
+	case view.AggTypeDistribution:
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, v.Description, name)
+	default:
+		return
+	}
+
+	for _, row := range rows {
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(row), data.Value)
+		case *view.SumData:
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(row), formatFloat(data.Value))
+		case *view.LastValueData:
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(row), formatFloat(data.Value))
+		case *view.DistributionData:
+			var cumulative int64
+			for i, bound := range v.Aggregation.Buckets {
+				if i < len(data.CountPerBucket) {
+					cumulative += data.CountPerBucket[i]
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(row, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(row, "le", "+Inf"), data.Count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(row), formatFloat(data.Mean*float64(data.Count)))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(row), data.Count)
+		}
+	}
+}
+
+// newMetricsServer returns the server for Prometheus scrapes.
+// Readiness is answered here too, as this listener keeps serving
+// while the proxy drains.
+func newMetricsServer(cfg *MetricsConfig, readinessPath string, ready http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(cfg.path(), &prometheusHandler{views: Views})
+	if readinessPath != "" {
+		mux.Handle(readinessPath, ready)
+	}
+
+	return &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: mux,
+	}
+}
+
+// serveMetrics serves Prometheus scrapes on ln until the server is
+// closed or the listener fails.
+func serveMetrics(srv *http.Server, ln net.Listener, cfg *MetricsConfig, logger Logger) error {
+	logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Info,
+		Labels: map[string]string{
+			"listenAddress": cfg.ListenAddress,
+			"path":          cfg.path(),
+		},
+		Payload: "Serving metrics",
+	})
+
+	return srv.Serve(ln)
+}
+
+// serverErrorLog receives the http.Server's error log, counting
+// TLS handshake failures and passing every line to the Logger.
+type serverErrorLog struct {
+	logger Logger
+}
+
+func (l *serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.Contains(msg, "TLS handshake error") {
+		record(context.Background(), nil, tlsHandshakeErrors.M(1))
+	}
+
+	l.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Warning,
+		Payload:   msg,
+	})
+
+	return len(p), nil
+}
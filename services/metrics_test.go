@@ -0,0 +1,53 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	if err := view.Register(Views...); err != nil {
+		t.Fatalf("failed to register views: %v", err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "metrics-test", Target: upstream.URL},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://metrics-test/", nil))
+	}
+
+	rec := httptest.NewRecorder()
+	(&prometheusHandler{views: Views}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	for _, expected := range []string{
+		"# TYPE butler_requests_total counter",
+		`butler_requests_total{code="202",route="metrics-test/*",upstream="` + host + `"} 3`,
+		"# TYPE butler_request_latency_seconds histogram",
+		`butler_request_latency_seconds_bucket{route="metrics-test/*",le="+Inf"} 3`,
+		`butler_request_latency_seconds_count{route="metrics-test/*"} 3`,
+		`butler_in_flight{route="metrics-test/*"} 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected metrics to contain %q, received:\n%s", expected, body)
+		}
+	}
+}
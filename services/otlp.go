@@ -0,0 +1,453 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/net/http2"
+)
+
+// OTLP protocols understood by OTLPConfig.Protocol.
+const (
+	OTLPHTTP = "http/protobuf"
+	OTLPGRPC = "grpc"
+)
+
+const (
+	otlpTracesPath     = "/v1/traces"
+	otlpGRPCMethod     = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+	otlpMaxQueue       = 2048
+	defaultOTLPBatch   = 512
+	defaultOTLPFlush   = 5 * time.Second
+	defaultOTLPTimeout = 10 * time.Second
+)
+
+// OTLPConfig configures exporting spans to an OpenTelemetry
+// collector over OTLP/HTTP or OTLP/gRPC.
+type OTLPConfig struct {
+	// Endpoint is the collector's base URL, e.g. http://localhost:4318
+	// for OTLP/HTTP or http://localhost:4317 for OTLP/gRPC. Plain http
+	// endpoints use h2c for gRPC.
+	Endpoint      string            `json:"endpoint"`
+	Protocol      string            `json:"protocol,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Timeout       Duration          `json:"timeout,omitempty"`
+	BatchSize     int               `json:"batchSize,omitempty"`
+	FlushInterval Duration          `json:"flushInterval,omitempty"`
+	ServiceName   string            `json:"serviceName,omitempty"`
+}
+
+// otlpExporter is a trace.Exporter that batches spans and
+// sends them to a collector.
+type otlpExporter struct {
+	cfg    OTLPConfig
+	url    string
+	grpc   bool
+	client *http.Client
+	logger Logger
+
+	mu    sync.Mutex
+	spans []*trace.SpanData
+	send  sync.Mutex
+
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newOTLPExporter(cfg OTLPConfig, logger Logger) (*otlpExporter, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, errors.Errorf("invalid OTLP endpoint: %s", cfg.Endpoint)
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Duration(defaultOTLPTimeout)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultOTLPBatch
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = Duration(defaultOTLPFlush)
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = logName
+	}
+
+	e := &otlpExporter{
+		cfg:    cfg,
+		logger: logger,
+		full:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	var transport http.RoundTripper
+	switch cfg.Protocol {
+	case "", OTLPHTTP:
+		if endpoint.Path == "" || endpoint.Path == "/" {
+			endpoint.Path = otlpTracesPath
+		}
+		transport = http.DefaultTransport
+	case OTLPGRPC:
+		e.grpc = true
+		endpoint.Path = otlpGRPCMethod
+		transport = &http2.Transport{}
+		if endpoint.Scheme == "http" {
+			// gRPC without TLS is HTTP/2 with prior knowledge.
+			transport = &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}
+		}
+	default:
+		return nil, errors.Errorf("unknown OTLP protocol: %s", cfg.Protocol)
+	}
+
+	e.url = endpoint.String()
+	e.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(cfg.Timeout),
+	}
+
+	return e, nil
+}
+
+// start flushes batches in the background until close is called.
+func (e *otlpExporter) start() {
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(time.Duration(e.cfg.FlushInterval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+			case <-e.full:
+			}
+			e.Flush()
+		}
+	}()
+}
+
+// close stops the background flush and sends whatever is left.
+func (e *otlpExporter) close() {
+	close(e.stop)
+	<-e.done
+	e.Flush()
+}
+
+// ExportSpan implements trace.Exporter.
+func (e *otlpExporter) ExportSpan(sd *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// drop spans rather than grow without bound when the
+	// collector can't keep up.
+	if len(e.spans) >= otlpMaxQueue {
+		return
+	}
+
+	e.spans = append(e.spans, sd)
+	if len(e.spans) >= e.cfg.BatchSize {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush sends all buffered spans.
+func (e *otlpExporter) Flush() {
+	e.send.Lock()
+	defer e.send.Unlock()
+
+	for {
+		e.mu.Lock()
+		batch := e.spans
+		if len(batch) > e.cfg.BatchSize {
+			batch = batch[:e.cfg.BatchSize]
+		}
+		e.spans = e.spans[len(batch):]
+		e.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := e.export(batch); err != nil {
+			e.logger.Log(logging.Entry{
+				Timestamp: time.Now().UTC(),
+				Severity:  logging.Warning,
+				Labels: map[string]string{
+					"endpoint": e.url,
+					"spans":    strconv.Itoa(len(batch)),
+				},
+				Payload: "Failed to export spans: " + err.Error(),
+			})
+		}
+	}
+}
+
+func (e *otlpExporter) export(batch []*trace.SpanData) error {
+	body := encodeTraces(e.cfg.ServiceName, batch)
+
+	contentType := "application/x-protobuf"
+	if e.grpc {
+		// a gRPC message is prefixed with a compression flag
+		// and its big-endian length.
+		framed := make([]byte, 5+len(body))
+		binary.BigEndian.PutUint32(framed[1:5], uint32(len(body)))
+		copy(framed[5:], body)
+		body = framed
+		contentType = "application/grpc"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.cfg.Timeout))
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "butler")
+	if e.grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// trailers are only populated once the body is consumed.
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("collector responded with %s", res.Status)
+	}
+
+	if e.grpc {
+		if status, msg := grpcStatus(res); status != "0" {
+			return errors.Errorf("collector responded with gRPC status %s: %s", status, msg)
+		}
+	}
+
+	return nil
+}
+
+// protoBuffer is a minimal protocol buffer encoder,
+// enough to write OTLP trace requests.
+type protoBuffer struct {
+	b []byte
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func (p *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		p.b = append(p.b, byte(v)|0x80)
+		v >>= 7
+	}
+	p.b = append(p.b, byte(v))
+}
+
+func (p *protoBuffer) key(field, wire int) {
+	p.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (p *protoBuffer) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	p.key(field, wireVarint)
+	p.varint(v)
+}
+
+func (p *protoBuffer) fixed64(field int, v uint64) {
+	p.key(field, wireFixed64)
+	p.b = append(p.b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(p.b[len(p.b)-8:], v)
+}
+
+func (p *protoBuffer) fixed32(field int, v uint32) {
+	p.key(field, wireFixed32)
+	p.b = append(p.b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(p.b[len(p.b)-4:], v)
+}
+
+func (p *protoBuffer) bytes(field int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	p.key(field, wireBytes)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+// message writes the sub-message built by fn, even when it is empty.
+func (p *protoBuffer) message(field int, fn func(m *protoBuffer)) {
+	var m protoBuffer
+	fn(&m)
+	p.key(field, wireBytes)
+	p.varint(uint64(len(m.b)))
+	p.b = append(p.b, m.b...)
+}
+
+// attribute writes an opentelemetry.proto.common.v1.KeyValue.
+func (p *protoBuffer) attribute(field int, key string, value interface{}) {
+	p.message(field, func(kv *protoBuffer) {
+		kv.string(1, key)
+		kv.message(2, func(v *protoBuffer) {
+			switch val := value.(type) {
+			case string:
+				v.string(1, val)
+			case bool:
+				v.key(2, wireVarint)
+				if val {
+					v.varint(1)
+				} else {
+					v.varint(0)
+				}
+			case int64:
+				v.key(3, wireVarint)
+				v.varint(uint64(val))
+			case float64:
+				v.fixed64(4, math.Float64bits(val))
+			default:
+				v.string(1, fmt.Sprint(val))
+			}
+		})
+	})
+}
+
+func (p *protoBuffer) attributes(field int, attrs map[string]interface{}) {
+	for k, v := range attrs {
+		p.attribute(field, k, v)
+	}
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// encodeTraces encodes an
+// opentelemetry.proto.collector.trace.v1.ExportTraceServiceRequest.
+func encodeTraces(service string, spans []*trace.SpanData) []byte {
+	var req protoBuffer
+	req.message(1, func(rs *protoBuffer) {
+		rs.message(1, func(res *protoBuffer) {
+			res.attribute(1, "service.name", service)
+		})
+		rs.message(2, func(ss *protoBuffer) {
+			ss.message(1, func(scope *protoBuffer) {
+				scope.string(1, "github.com/ninnemana/butler")
+			})
+			for _, sd := range spans {
+				ss.message(2, func(s *protoBuffer) {
+					encodeSpan(s, sd)
+				})
+			}
+		})
+	})
+
+	return req.b
+}
+
+func encodeSpan(s *protoBuffer, sd *trace.SpanData) {
+	s.bytes(1, sd.TraceID[:])
+	s.bytes(2, sd.SpanID[:])
+
+	if entries := sd.Tracestate.Entries(); len(entries) > 0 {
+		pairs := make([]string, len(entries))
+		for i, e := range entries {
+			pairs[i] = e.Key + "=" + e.Value
+		}
+		s.string(3, strings.Join(pairs, ","))
+	}
+
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		s.bytes(4, sd.ParentSpanID[:])
+	}
+	s.string(5, sd.Name)
+
+	// OpenCensus and OTLP number span kinds differently.
+	switch sd.SpanKind {
+	case trace.SpanKindServer:
+		s.uint(6, 2)
+	case trace.SpanKindClient:
+		s.uint(6, 3)
+	default:
+		s.uint(6, 1)
+	}
+
+	s.fixed64(7, unixNano(sd.StartTime))
+	s.fixed64(8, unixNano(sd.EndTime))
+	s.attributes(9, sd.Attributes)
+
+	for _, a := range sd.Annotations {
+		s.message(11, func(ev *protoBuffer) {
+			ev.fixed64(1, unixNano(a.Time))
+			ev.string(2, a.Message)
+			ev.attributes(3, a.Attributes)
+		})
+	}
+
+	for _, l := range sd.Links {
+		s.message(13, func(link *protoBuffer) {
+			link.bytes(1, l.TraceID[:])
+			link.bytes(2, l.SpanID[:])
+			link.attributes(4, l.Attributes)
+		})
+	}
+
+	s.message(15, func(status *protoBuffer) {
+		status.string(2, sd.Message)
+		if sd.Code != 0 {
+			// STATUS_CODE_ERROR
+			status.uint(3, 2)
+		}
+	})
+
+	s.fixed32(16, uint32(sd.TraceOptions)&1)
+}
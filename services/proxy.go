@@ -0,0 +1,278 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+var errNoBackend = errors.New("no upstream available")
+
+// newProxy builds the reverse proxy for a route. The upstream is not
+// chosen until the request reaches the transport, so one proxy can
+// spread requests over all of the route's backends.
+func newProxy(r *route, tlsConfig *tls.Config) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		ErrorHandler:  r.proxyError,
+		FlushInterval: flushInterval(r.Protocol),
+		Transport: &upstreamTransport{
+			route: r,
+			base:  newBaseTransport(r, tlsConfig),
+		},
+	}
+}
+
+// flushInterval streams HTTP/2 responses, such as gRPC
+// streams, to clients as they arrive.
+func flushInterval(protocol string) time.Duration {
+	if protocol == ProtocolH2 || protocol == ProtocolH2C {
+		return -1
+	}
+
+	return 0
+}
+
+// upstreamTransport picks a backend for each request and
+// tracks how many requests each backend is serving.
+type upstreamTransport struct {
+	route *route
+	base  http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retry := t.route.retry
+	attempts, body, err := retry.prepare(req)
+	if err != nil {
+		return nil, err
+	}
+	if retry != nil {
+		retry.budget.request(time.Now())
+	}
+
+	var tried []*Backend
+	for attempt := 1; ; attempt++ {
+		b := t.route.pick(req, tried...)
+		if b == nil {
+			record(req.Context(), []tag.Mutator{
+				tag.Upsert(keyRoute, t.route.key),
+				tag.Upsert(keyUpstream, "none"),
+				tag.Upsert(keyError, errorType(errNoBackend)),
+			}, upstreamErrors.M(1))
+			return nil, errNoBackend
+		}
+		tried = append(tried, b)
+
+		res, err := t.send(req, b, body, attempt)
+		if attempt >= attempts || req.Context().Err() != nil || !retry.retryable(res, err) {
+			return res, err
+		}
+
+		result := "retried"
+		if !retry.budget.withdraw(time.Now()) {
+			result = "budget_exhausted"
+		}
+		record(req.Context(), []tag.Mutator{
+			tag.Upsert(keyRoute, t.route.key),
+			tag.Upsert(keyResult, result),
+		}, upstreamRetries.M(1))
+		if result != "retried" {
+			return res, err
+		}
+
+		if res != nil {
+			discard(res)
+		}
+
+		if err := retry.wait(req.Context(), attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// send makes one attempt at sending req to b, with a fresh copy
+// of body when the request is being retried.
+func (t *upstreamTransport) send(req *http.Request, b *Backend, body []byte, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	out := req.Clone(ctx)
+	if body != nil {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	out.URL.Scheme = b.URL.Scheme
+	out.URL.Host = b.URL.Host
+	out.URL.Path = singleJoiningSlash(b.URL.Path, req.URL.Path)
+	if req.URL.RawPath != "" {
+		out.URL.RawPath = singleJoiningSlash(b.URL.EscapedPath(), req.URL.RawPath)
+	}
+	switch {
+	case b.URL.RawQuery == "" || req.URL.RawQuery == "":
+		out.URL.RawQuery = b.URL.RawQuery + req.URL.RawQuery
+	default:
+		out.URL.RawQuery = b.URL.RawQuery + "&" + req.URL.RawQuery
+	}
+	if !t.route.PreserveHost {
+		out.Host = b.URL.Host
+	}
+
+	state := requestFrom(req.Context())
+	if state != nil {
+		state.upstream = b.URL.Host
+	}
+
+	mutators := []tag.Mutator{
+		tag.Upsert(keyRoute, t.route.key),
+		tag.Upsert(keyUpstream, b.URL.Host),
+	}
+
+	_, span := trace.StartSpan(req.Context(), "butler.upstream", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("butler.route", t.route.key),
+		trace.StringAttribute("http.url", out.URL.String()),
+		trace.StringAttribute("net.peer.name", b.URL.Host),
+		trace.Int64Attribute("butler.attempt", int64(attempt)),
+	)
+	if state != nil && state.format != nil {
+		state.format.SpanContextToRequest(span.SpanContext(), out)
+	}
+
+	start := time.Now()
+	timer := startHeaderTimer(time.Duration(t.route.timeouts.ResponseHeader), cancel)
+	res, err := t.base.RoundTrip(out)
+	if timer.stop() {
+		if err == nil {
+			res.Body.Close()
+			res, err = nil, ctx.Err()
+		}
+		err = &upstreamTimeout{kind: timeoutResponseHeader, err: err}
+	}
+	latency := time.Since(start)
+	if state != nil {
+		state.upstreamLatency = latency
+	}
+	t.route.report(b, requestOutcome(res, err))
+	if err != nil {
+		cancel()
+		b.release()
+		record(req.Context(), append(mutators, tag.Upsert(keyError, errorType(err))), upstreamErrors.M(1))
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnavailable, Message: err.Error()})
+		return nil, err
+	}
+	record(req.Context(), mutators, upstreamLatency.M(latency.Seconds()))
+	span.AddAttributes(trace.Int64Attribute("http.status_code", int64(res.StatusCode)))
+
+	// upgraded connections can stay quiet for as long as they like.
+	if idle := time.Duration(t.route.timeouts.Idle); idle > 0 && res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body = newIdleBody(res.Body, idle, cancel)
+	}
+	res.Body = trackBody(res.Body, func() {
+		b.release()
+		cancel()
+	})
+
+	return res, nil
+}
+
+func (t *upstreamTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// trackBody calls done once the body is closed. Bodies of upgraded
+// connections stay writable so the proxy can still use them.
+func trackBody(body io.ReadCloser, done func()) io.ReadCloser {
+	tb := &trackedBody{ReadCloser: body, done: done}
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &trackedReadWriteBody{trackedBody: tb, w: rwc}
+	}
+
+	return tb
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	done   func()
+	closed int32
+}
+
+func (b *trackedBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		b.done()
+	}
+
+	return b.ReadCloser.Close()
+}
+
+type trackedReadWriteBody struct {
+	*trackedBody
+	w io.Writer
+}
+
+func (b *trackedReadWriteBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// errorType classifies an upstream error for metrics and logs.
+func errorType(err error) string {
+	if err == errNoBackend {
+		return "no_upstream"
+	}
+
+	if err == context.Canceled {
+		return "canceled"
+	}
+
+	if err == context.DeadlineExceeded {
+		return "timeout"
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+
+	if oe, ok := err.(*net.OpError); ok && oe.Op == "dial" {
+		return "connect"
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+		return "tls"
+	case strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe") || err == io.EOF || err == io.ErrUnexpectedEOF:
+		return "reset"
+	case strings.Contains(msg, "connection refused"):
+		return "connect"
+	default:
+		return "other"
+	}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,522 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the JWT algorithms
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// Rate limit algorithms understood by RateLimit.Algorithm.
+const (
+	TokenBucket   = "token_bucket"
+	SlidingWindow = "sliding_window"
+)
+
+// MemoryStore is the name of the in-memory RateLimitStore
+// used when a policy doesn't name one.
+const MemoryStore = "memory"
+
+const (
+	defaultRateLimitWindow = time.Second
+	rateLimitSweepInterval = time.Minute
+)
+
+// RateLimit limits how many requests each client can make to a route
+// within Window. Clients are told apart by Header or a Claim of the
+// bearer JWT when set and by their IP otherwise. Clients can send any
+// header or token they like, so Header is only believed from trusted
+// proxies and Claim from trusted proxies or once the token verifies
+// against JWTKeyFile; other requests are limited by IP.
+//
+// The token bucket allows bursts of up to Burst requests (Limit by
+// default) and refills at Limit per Window. The sliding window allows
+// Limit requests in any Window.
+type RateLimit struct {
+	Algorithm string   `json:"algorithm,omitempty"`
+	Limit     int      `json:"limit"`
+	Window    Duration `json:"window,omitempty"`
+	Burst     int      `json:"burst,omitempty"`
+	Header    string   `json:"header,omitempty"`
+	Claim     string   `json:"claim,omitempty"`
+	// JWTKeyFile holds the PEM public key (RSA or ECDSA) or the HMAC
+	// secret that signs the tokens Claim is read from.
+	JWTKeyFile string `json:"jwtKeyFile,omitempty"`
+	// Store names the RateLimitStore keeping the state,
+	// MemoryStore by default.
+	Store string `json:"store,omitempty"`
+}
+
+func (r RateLimit) window() time.Duration {
+	if r.Window <= 0 {
+		return defaultRateLimitWindow
+	}
+
+	return time.Duration(r.Window)
+}
+
+func (r RateLimit) burst() int {
+	if r.Burst <= 0 {
+		return r.Limit
+	}
+
+	return r.Burst
+}
+
+// RateLimitDecision is a store's verdict on a request.
+type RateLimitDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the client's full quota is available
+	// again and RetryAfter how long until its next request is allowed.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps rate limit state. Replicas sharing a store
+// share their limits, so a store backed by a shared database lets
+// limits apply across a whole deployment.
+type RateLimitStore interface {
+	// Allow counts a request by the client identified by key against
+	// the policy and reports whether it's within the limit.
+	Allow(ctx context.Context, key string, policy RateLimit) (RateLimitDecision, error)
+}
+
+var (
+	rateLimitStoresMu sync.RWMutex
+	rateLimitStores   = map[string]RateLimitStore{
+		MemoryStore: newMemoryStore(),
+	}
+)
+
+// RegisterRateLimitStore makes a store available to rate limit policies
+// under name, replacing any store already registered with that name.
+func RegisterRateLimitStore(name string, store RateLimitStore) {
+	rateLimitStoresMu.Lock()
+	defer rateLimitStoresMu.Unlock()
+
+	rateLimitStores[name] = store
+}
+
+// rateLimiter applies a route's rate limit policy.
+type rateLimiter struct {
+	route  string
+	policy RateLimit
+	store  RateLimitStore
+	jwt    *jwtVerifier
+}
+
+func newRateLimiter(route string, policy *RateLimit) (*rateLimiter, error) {
+	if policy == nil {
+		return nil, nil
+	}
+
+	switch policy.Algorithm {
+	case "":
+		policy.Algorithm = TokenBucket
+	case TokenBucket, SlidingWindow:
+	default:
+		return nil, errors.Errorf("unknown rate limit algorithm: %s", policy.Algorithm)
+	}
+
+	if policy.Limit <= 0 {
+		return nil, errors.New("rate limit must be positive")
+	}
+
+	if policy.Header != "" && policy.Claim != "" {
+		return nil, errors.New("rate limit accepts either a header or a claim, not both")
+	}
+
+	var jwt *jwtVerifier
+	if policy.JWTKeyFile != "" {
+		if policy.Claim == "" {
+			return nil, errors.New("rate limit JWT key needs a claim")
+		}
+
+		var err error
+		if jwt, err = loadJWTKey(policy.JWTKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	name := policy.Store
+	if name == "" {
+		name = MemoryStore
+	}
+
+	rateLimitStoresMu.RLock()
+	store, ok := rateLimitStores[name]
+	rateLimitStoresMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown rate limit store: %s", name)
+	}
+
+	return &rateLimiter{route: route, policy: *policy, store: store, jwt: jwt}, nil
+}
+
+// key identifies the client making the request. The header and
+// claim are only believed when a trusted proxy set them or, for the
+// claim, when the token's signature verifies.
+func (l *rateLimiter) key(r *http.Request, ip net.IP, trusted bool) string {
+	switch {
+	case l.policy.Header != "" && trusted:
+		if v := r.Header.Get(l.policy.Header); v != "" {
+			return "header:" + v
+		}
+	case l.policy.Claim != "" && (trusted || l.jwt != nil):
+		if v := jwtClaim(r, l.policy.Claim, l.jwt); v != "" {
+			return "claim:" + v
+		}
+	}
+
+	// clients without the header or claim share
+	// the limit of their IP address.
+	return "ip:" + ip.String()
+}
+
+// jwtClaim returns a claim from the request's bearer token. Unless v
+// is nil, the token must be signed by v's key and not have expired.
+func jwtClaim(r *http.Request, claim string, v *jwtVerifier) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+
+	token := strings.TrimPrefix(auth, "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	if v != nil && !v.verify(parts[0], token[:strings.LastIndex(token, ".")], parts[2]) {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && v != nil && time.Now().Unix() >= int64(exp) {
+		return ""
+	}
+
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// jwtVerifier checks the signatures of bearer tokens
+// with one key, accepting only the algorithms it suits.
+type jwtVerifier struct {
+	secret []byte
+	rsa    *rsa.PublicKey
+	ecdsa  *ecdsa.PublicKey
+}
+
+// loadJWTKey reads a PEM public key or certificate, or failing
+// that an HMAC secret, from file.
+func loadJWTKey(file string) (*jwtVerifier, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read JWT key")
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, errors.Errorf("no JWT key found in %s", file)
+		}
+		return &jwtVerifier{secret: secret}, nil
+	}
+
+	var key interface{}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse JWT certificate")
+		}
+		key = cert.PublicKey
+	} else if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, errors.Wrap(err, "failed to parse JWT key")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return &jwtVerifier{rsa: key}, nil
+	case *ecdsa.PublicKey:
+		return &jwtVerifier{ecdsa: key}, nil
+	default:
+		return nil, errors.Errorf("unsupported JWT key type %T", key)
+	}
+}
+
+// verify reports whether sig is a valid signature of signed, the
+// token's header and payload, by an algorithm named in its header.
+func (v *jwtVerifier) verify(header, signed, sig string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return false
+	}
+
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(data, &h); err != nil || len(h.Alg) != 5 {
+		return false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	var hash crypto.Hash
+	switch h.Alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	switch {
+	case h.Alg[:2] == "HS" && v.secret != nil:
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case h.Alg[:2] == "RS" && v.rsa != nil:
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		return rsa.VerifyPKCS1v15(v.rsa, hash, digest.Sum(nil), signature) == nil
+	case h.Alg[:2] == "ES" && v.ecdsa != nil:
+		size := (v.ecdsa.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(v.ecdsa, digest.Sum(nil), r, s)
+	default:
+		return false
+	}
+}
+
+// rateLimit applies the route's policy to the request, setting the
+// RateLimit headers, and reports whether the request may proceed.
+// Requests are let through when the store fails.
+func (h *handler) rateLimit(r *request, l *rateLimiter) bool {
+	ctx := r.request.Context()
+	peer := remoteIP(r.request)
+	trusted := peer != nil && h.trusted.contains(peer)
+	d, err := l.store.Allow(ctx, l.route+"|"+l.key(r.request, r.clientIP, trusted), l.policy)
+	if err != nil {
+		r.entry.Severity = logging.Warning
+		r.entry.Payload = "Rate limit store failed: " + err.Error()
+		h.logger.Log(r.entry)
+		return true
+	}
+
+	header := r.response.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(seconds(d.Reset)))
+
+	if d.Allowed {
+		return true
+	}
+
+	record(ctx, []tag.Mutator{tag.Upsert(keyRoute, l.route)}, rateLimited.M(1))
+	r.span.SetStatus(trace.Status{Code: trace.StatusCodeResourceExhausted, Message: "rate limited"})
+
+	header.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	http.Error(r.response, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+	return false
+}
+
+// seconds rounds d up to whole seconds for headers.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// memoryStore keeps rate limit state for this process only.
+type memoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// bucket holds the state of either algorithm for one client:
+// tokens for the token bucket, the counts of the current and
+// previous windows for the sliding window.
+type bucket struct {
+	tokens      float64
+	updated     time.Time
+	start       time.Time
+	prev, count int
+	expires     time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+func (s *memoryStore) Allow(ctx context.Context, key string, policy RateLimit) (RateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok || now.After(b.expires) {
+		b = &bucket{tokens: float64(policy.burst()), updated: now, start: now}
+		s.buckets[key] = b
+	}
+
+	var d RateLimitDecision
+	switch policy.Algorithm {
+	case SlidingWindow:
+		d = b.slidingWindow(now, policy)
+	case TokenBucket, "":
+		d = b.tokenBucket(now, policy)
+	default:
+		return d, errors.Errorf("unknown rate limit algorithm: %s", policy.Algorithm)
+	}
+
+	// state is kept until it would have reset anyway.
+	b.expires = now.Add(d.Reset + policy.window())
+	return d, nil
+}
+
+// sweep forgets clients whose state has expired.
+func (s *memoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		if now.After(b.expires) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (b *bucket) tokenBucket(now time.Time, policy RateLimit) RateLimitDecision {
+	capacity := float64(policy.burst())
+	rate := float64(policy.Limit) / policy.window().Seconds()
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	d := RateLimitDecision{Limit: policy.burst()}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = duration((1 - b.tokens) / rate)
+	}
+
+	d.Remaining = int(b.tokens)
+	d.Reset = duration((capacity - b.tokens) / rate)
+
+	return d
+}
+
+// slidingWindow approximates the requests made in the last window by
+// weighting the previous fixed window's count by how much of it still
+// overlaps.
+func (b *bucket) slidingWindow(now time.Time, policy RateLimit) RateLimitDecision {
+	window := policy.window()
+
+	elapsed := now.Sub(b.start)
+	if elapsed >= window {
+		windows := elapsed / window
+		if windows == 1 {
+			b.prev = b.count
+		} else {
+			b.prev = 0
+		}
+		b.count = 0
+		b.start = b.start.Add(windows * window)
+		elapsed = now.Sub(b.start)
+	}
+
+	overlap := 1 - float64(elapsed)/float64(window)
+	estimate := float64(b.prev)*overlap + float64(b.count)
+
+	d := RateLimitDecision{Limit: policy.Limit}
+	if estimate+1 <= float64(policy.Limit) {
+		b.count++
+		estimate++
+		d.Allowed = true
+	} else {
+		// the estimate falls as the previous window slides out,
+		// or drops to the current count when the window ends.
+		d.RetryAfter = window - elapsed
+		if b.prev > 0 && float64(b.count)+1 <= float64(policy.Limit) {
+			excess := estimate + 1 - float64(policy.Limit)
+			d.RetryAfter = time.Duration(excess / float64(b.prev) * float64(window))
+		}
+	}
+
+	d.Remaining = int(math.Max(0, float64(policy.Limit)-math.Ceil(estimate)))
+
+	// the full quota is back once both counted windows have slid out.
+	switch {
+	case b.count > 0:
+		d.Reset = 2*window - elapsed
+	case b.prev > 0:
+		d.Reset = window - elapsed
+	default:
+		d.Reset = 0
+	}
+
+	return d
+}
+
+func duration(secs float64) time.Duration {
+	return time.Duration(secs * float64(time.Second))
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := newMemoryStore()
+	store.now = func() time.Time { return now }
+
+	policy := RateLimit{Algorithm: TokenBucket, Limit: 2, Window: Duration(time.Second)}
+	for i := 0; i < 2; i++ {
+		if d, _ := store.Allow(context.Background(), "client", policy); !d.Allowed {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+
+	d, _ := store.Allow(context.Background(), "client", policy)
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("expected the empty bucket to reject for 500ms, received %+v", d)
+	}
+
+	if d, _ := store.Allow(context.Background(), "other", policy); !d.Allowed {
+		t.Error("expected other clients to have their own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if d, _ := store.Allow(context.Background(), "client", policy); !d.Allowed {
+		t.Error("expected a token to have been refilled")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := newMemoryStore()
+	store.now = func() time.Time { return now }
+
+	policy := RateLimit{Algorithm: SlidingWindow, Limit: 3, Window: Duration(10 * time.Second)}
+	allow := func() RateLimitDecision {
+		d, err := store.Allow(context.Background(), "client", policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	for i := 0; i < 3; i++ {
+		if d := allow(); !d.Allowed || d.Remaining != 2-i {
+			t.Fatalf("expected request %d to be allowed, received %+v", i, d)
+		}
+	}
+	if d := allow(); d.Allowed || d.RetryAfter != 10*time.Second {
+		t.Fatalf("expected the full window to reject until it ends, received %+v", d)
+	}
+
+	// halfway through the next window half of the previous
+	// one still counts: 1.5 requests, so one more is allowed.
+	now = now.Add(15 * time.Second)
+	if d := allow(); !d.Allowed {
+		t.Fatalf("expected a request to be allowed, received %+v", d)
+	}
+
+	d := allow()
+	if d.Allowed {
+		t.Fatalf("expected the estimate to exceed the limit, received %+v", d)
+	}
+	if d.RetryAfter != 5*time.Second/3 {
+		t.Errorf("expected a retry once the previous window slides out further, received %s", d.RetryAfter)
+	}
+
+	now = now.Add(30 * time.Second)
+	if d := allow(); !d.Allowed {
+		t.Error("expected the limit to reset after an idle window")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Allow(context.Context, string, RateLimit) (RateLimitDecision, error) {
+	return RateLimitDecision{}, errors.New("unavailable")
+}
+
+func TestRateLimitRoute(t *testing.T) {
+	RegisterRateLimitStore("failing", failingStore{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "key.test", Target: upstream.URL, RateLimit: &RateLimit{Limit: 1, Window: Duration(time.Minute), Header: "X-Api-Key"}},
+		{Host: "jwt.test", Target: upstream.URL, RateLimit: &RateLimit{Algorithm: SlidingWindow, Limit: 1, Window: Duration(time.Minute), Claim: "sub"}},
+		{Host: "failing.test", Target: upstream.URL, RateLimit: &RateLimit{Limit: 1, Store: "failing"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	// requests from httptest come from 192.0.2.1.
+	trusted, _ := parseCIDRs([]string{"192.0.2.0/24"})
+	h := &handler{logger: logger, trusted: trusted}
+	h.setTable(table)
+
+	getFrom := func(remote, host string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if remote != "" {
+			req.RemoteAddr = remote
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(host string, header http.Header) *httptest.ResponseRecorder {
+		return getFrom("", host, header)
+	}
+
+	alice := http.Header{"X-Api-Key": {"alice"}}
+	if rec := get("key.test", alice); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "1" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("expected first request to pass with RateLimit headers, received %d %v", rec.Code, rec.Header())
+	}
+
+	rec := get("key.test", alice)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected second request to be limited, received %d %v", rec.Code, rec.Header())
+	}
+
+	if rec := get("key.test", http.Header{"X-Api-Key": {"bob"}}); rec.Code != http.StatusOK {
+		t.Errorf("expected another key to have its own limit, received %d", rec.Code)
+	}
+
+	token := func(sub string) http.Header {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + sub + `"}`))
+		return http.Header{"Authorization": {"Bearer e30." + payload + ".sig"}}
+	}
+	get("jwt.test", token("carol"))
+	if rec := get("jwt.test", token("carol")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the claim to be limited, received %d", rec.Code)
+	}
+	if rec := get("jwt.test", token("dave")); rec.Code != http.StatusOK {
+		t.Errorf("expected another subject to have its own limit, received %d", rec.Code)
+	}
+
+	// anyone else's headers and unsigned tokens are limited by IP.
+	getFrom("198.51.100.7:1234", "key.test", http.Header{"X-Api-Key": {"erin"}})
+	if rec := getFrom("198.51.100.7:1234", "key.test", http.Header{"X-Api-Key": {"frank"}}); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected untrusted clients not to escape the limit with new keys, received %d", rec.Code)
+	}
+
+	getFrom("198.51.100.8:1234", "jwt.test", token("grace"))
+	if rec := getFrom("198.51.100.8:1234", "jwt.test", token("heidi")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected unverified tokens from untrusted clients to be limited by IP, received %d", rec.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := get("failing.test", nil); rec.Code != http.StatusOK {
+			t.Errorf("expected requests to pass when the store fails, received %d", rec.Code)
+		}
+	}
+
+	for _, invalid := range []*RateLimit{
+		{Limit: 0},
+		{Limit: 1, Algorithm: "leaky"},
+		{Limit: 1, Header: "X-Api-Key", Claim: "sub"},
+		{Limit: 1, Store: "redis"},
+		{Limit: 1, JWTKeyFile: "key.pem"},
+		{Limit: 1, Claim: "sub", JWTKeyFile: "missing.pem"},
+	} {
+		if _, err := newRateLimiter("test", invalid); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimitVerifiedClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := filepath.Join(dir, "public.pem")
+	if err := ioutil.WriteFile(public, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(v string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(v))
+	}
+	hs256 := func(claims string, key []byte) string {
+		signed := encode(`{"alg":"HS256"}`) + "." + encode(claims)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	es256 := func(claims string) string {
+		signed := encode(`{"alg":"ES256"}`) + "." + encode(claims)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	hmacLimiter, err := newRateLimiter("test", &RateLimit{Limit: 1, Claim: "sub", JWTKeyFile: secret})
+	if err != nil {
+		t.Fatalf("failed to load the HMAC secret: %v", err)
+	}
+	ecLimiter, err := newRateLimiter("test", &RateLimit{Limit: 1, Claim: "sub", JWTKeyFile: public})
+	if err != nil {
+		t.Fatalf("failed to load the public key: %v", err)
+	}
+
+	tests := []struct {
+		limiter *rateLimiter
+		token   string
+		key     string
+	}{
+		{hmacLimiter, hs256(`{"sub":"alice"}`, []byte("s3cret")), "claim:alice"},
+		{hmacLimiter, hs256(`{"sub":"alice"}`, []byte("guess")), "ip:198.51.100.7"},
+		{hmacLimiter, hs256(`{"sub":"alice","exp":1}`, []byte("s3cret")), "ip:198.51.100.7"},
+		{hmacLimiter, encode(`{"alg":"none"}`) + "." + encode(`{"sub":"alice"}`) + ".", "ip:198.51.100.7"},
+		{ecLimiter, es256(`{"sub":"bob"}`), "claim:bob"},
+		{ecLimiter, hs256(`{"sub":"bob"}`, []byte("s3cret")), "ip:198.51.100.7"},
+	}
+
+	ip := net.ParseIP("198.51.100.7")
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		if key := tt.limiter.key(req, ip, false); key != tt.key {
+			t.Errorf("expected %s to be keyed by %s, received %s", tt.token, tt.key, key)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// watch reloads the route table whenever the configuration file
+// changes on disk or the process receives SIGHUP, and certificates
+// whenever their files change. It returns when done is closed.
+func (h *handler) watch(cfg *Config, done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(cfg.reloadInterval())
+	defer ticker.Stop()
+
+	last := stat(cfg.file)
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+			last = stat(cfg.file)
+			h.reload(cfg, "SIGHUP")
+			h.reloadCerts()
+		case <-ticker.C:
+			h.reloadCerts()
+			if cfg.file == "" {
+				continue
+			}
+
+			current := stat(cfg.file)
+			if current == nil || sameFile(last, current) {
+				continue
+			}
+
+			last = current
+			h.reload(cfg, "file changed")
+		}
+	}
+}
+
+// reload reads the configuration again and swaps in its route table,
+// with any changes made through the admin API applied on top. An
+// invalid configuration is logged and the current table stays live.
+func (h *handler) reload(cfg *Config, reason string) error {
+	next, err := cfg.reload()
+	if err != nil {
+		h.rejectReload(reason, err)
+		return err
+	}
+
+	h.runtime.mu.Lock()
+	defer h.runtime.mu.Unlock()
+
+	prev := h.runtime.targets
+	h.runtime.targets = next.Targets
+	changed, err := h.rebuild()
+	if err != nil {
+		h.runtime.targets = prev
+		h.rejectReload(reason, err)
+		return err
+	}
+
+	h.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Info,
+		Labels: map[string]string{
+			"reason":  reason,
+			"changed": strings.Join(changed, ","),
+		},
+		Payload: "Reloaded configuration",
+	})
+
+	return nil
+}
+
+// reloadCerts swaps in certificates whose files changed.
+func (h *handler) reloadCerts() {
+	if h.certs != nil {
+		h.certs.reload(h.logger)
+	}
+}
+
+func (h *handler) rejectReload(reason string, err error) {
+	h.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Error,
+		Labels: map[string]string{
+			"reason": reason,
+		},
+		Payload: "Rejected configuration reload: " + err.Error(),
+	})
+}
+
+func stat(file string) os.FileInfo {
+	if file == "" {
+		return nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+
+	return info
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	write := func(data string) {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	write(`{"targets": {"a": "http://a.local", "b": "http://b.local"}}`)
+	cfg, err := fromFile(file)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+
+	table, err := newRouteTable(cfg.Targets, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{
+		logger: logger,
+	}
+	h.routes.Store(table)
+
+	write(`{"targets": {"a": "http://a.local", "b": "http://b2.local", "c": "http://c.local"}}`)
+	if err := h.reload(cfg, "test"); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+
+	if m, ok := h.table().lookup("b", "/"); !ok || m.backends[0].URL.Host != "b2.local" {
+		t.Errorf("expected b to route to b2.local, received %v", m)
+	}
+
+	if _, ok := h.table().lookup("c", "/"); !ok {
+		t.Error("expected c to be routed after reload")
+	}
+
+	if h.table().keys["a/*"] != table.keys["a/*"] {
+		t.Error("expected unchanged route for a to be kept")
+	}
+
+	if h.table().keys["b/*"] == table.keys["b/*"] {
+		t.Error("expected route for b to be replaced")
+	}
+
+	write(`{"targets": {"a": "not a url"}}`)
+	if err := h.reload(cfg, "test"); err == nil {
+		t.Fatal("expected invalid configuration to be rejected")
+	}
+
+	if _, ok := h.table().lookup("c", "/"); !ok {
+		t.Error("expected previous table to stay live after rejected reload")
+	}
+}
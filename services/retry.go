@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryBackoff        = 25 * time.Millisecond
+	defaultRetryMaxBackoff     = 250 * time.Millisecond
+	defaultRetryBudget         = 0.2
+	defaultMinRetriesPerSecond = 10
+
+	// retryBudgetWindow is how far back the budget looks.
+	retryBudgetWindow = 10 * time.Second
+	// maxRetryBody is the largest request body
+	// buffered so it can be sent again.
+	maxRetryBody = 64 << 10
+)
+
+var (
+	// defaultRetryOn are the failures retried by default, those
+	// where the upstream can't have processed the request.
+	defaultRetryOn = []string{"connect", "reset"}
+	// defaultRetryMethods are the idempotent methods.
+	defaultRetryMethods = []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodOptions,
+		http.MethodTrace,
+		http.MethodPut,
+		http.MethodDelete,
+	}
+	// retryClasses are the failure classes reported by errorType.
+	retryClasses = map[string]bool{
+		"connect": true,
+		"reset":   true,
+		"timeout": true,
+		"tls":     true,
+		"other":   true,
+	}
+)
+
+// RetryPolicy sends a failed request again, to a different upstream
+// when the route has one, up to Attempts times in total. Failures of
+// the classes in On ("connect", "reset", "timeout", "tls" or "other")
+// are retried, as are responses with one of Statuses.
+//
+// Only requests using one of Methods, the idempotent methods by
+// default, are retried. Retries wait a random time of up to Backoff,
+// doubling with every attempt up to MaxBackoff. Budget caps retries at
+// a fraction of the route's requests, on top of MinRetriesPerSecond,
+// so retries can't multiply the load on struggling upstreams.
+type RetryPolicy struct {
+	Attempts            int      `json:"attempts,omitempty"`
+	On                  []string `json:"on,omitempty"`
+	Statuses            []int    `json:"statuses,omitempty"`
+	Methods             []string `json:"methods,omitempty"`
+	Backoff             Duration `json:"backoff,omitempty"`
+	MaxBackoff          Duration `json:"maxBackoff,omitempty"`
+	Budget              float64  `json:"budget,omitempty"`
+	MinRetriesPerSecond int      `json:"minRetriesPerSecond,omitempty"`
+}
+
+// retryPolicy is a compiled RetryPolicy.
+type retryPolicy struct {
+	cfg      RetryPolicy
+	on       map[string]bool
+	statuses map[int]bool
+	methods  map[string]bool
+	budget   *retryBudget
+}
+
+func newRetryPolicy(cfg *RetryPolicy) (*retryPolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	policy := *cfg
+
+	if policy.Attempts < 0 || policy.Backoff < 0 || policy.MaxBackoff < 0 || policy.MinRetriesPerSecond < 0 {
+		return nil, errors.New("retry limits must not be negative")
+	}
+
+	if policy.Budget < 0 || policy.Budget > 1 {
+		return nil, errors.Errorf("retry budget must be between 0 and 1: %v", policy.Budget)
+	}
+
+	if policy.Attempts == 0 {
+		policy.Attempts = defaultRetryAttempts
+	}
+	if len(policy.On) == 0 && len(policy.Statuses) == 0 {
+		policy.On = defaultRetryOn
+	}
+	if len(policy.Methods) == 0 {
+		policy.Methods = defaultRetryMethods
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = Duration(defaultRetryBackoff)
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = Duration(defaultRetryMaxBackoff)
+	}
+	if policy.Budget == 0 {
+		policy.Budget = defaultRetryBudget
+	}
+	if policy.MinRetriesPerSecond == 0 {
+		policy.MinRetriesPerSecond = defaultMinRetriesPerSecond
+	}
+
+	p := &retryPolicy{
+		cfg:      policy,
+		on:       map[string]bool{},
+		statuses: map[int]bool{},
+		methods:  map[string]bool{},
+		budget: &retryBudget{
+			ratio:   policy.Budget,
+			reserve: float64(policy.MinRetriesPerSecond) * retryBudgetWindow.Seconds(),
+			counts:  windowCounts{window: retryBudgetWindow},
+		},
+	}
+
+	for _, class := range policy.On {
+		if !retryClasses[class] {
+			return nil, errors.Errorf("unknown failure class: %s", class)
+		}
+		p.on[class] = true
+	}
+
+	for _, status := range policy.Statuses {
+		if status < 100 || status > 599 {
+			return nil, errors.Errorf("invalid status code: %d", status)
+		}
+		p.statuses[status] = true
+	}
+
+	for _, method := range policy.Methods {
+		p.methods[method] = true
+	}
+
+	return p, nil
+}
+
+// prepare returns how many times req may be sent and, when it has a
+// body, the body so it can be sent again. Requests the policy doesn't
+// apply to, or whose body is too large to buffer, are sent once.
+func (p *retryPolicy) prepare(req *http.Request) (int, []byte, error) {
+	if p == nil || !p.methods[req.Method] {
+		return 1, nil, nil
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return p.cfg.Attempts, nil, nil
+	}
+
+	if req.ContentLength < 0 || req.ContentLength > maxRetryBody {
+		return 1, nil, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to read request body")
+	}
+
+	return p.cfg.Attempts, body, nil
+}
+
+// retryable reports whether the result of an attempt should be retried.
+func (p *retryPolicy) retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return err != errNoBackend && p.on[errorType(err)]
+	}
+
+	return p.statuses[res.StatusCode]
+}
+
+// wait sleeps before the given retry, returning
+// early when the request is canceled.
+func (p *retryPolicy) wait(ctx context.Context, retry int) error {
+	backoff := time.Duration(p.cfg.Backoff) << uint(retry-1)
+	if max := time.Duration(p.cfg.MaxBackoff); backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryBudget allows retries up to a fraction of the requests
+// made in the last window, plus a reserve.
+type retryBudget struct {
+	ratio   float64
+	reserve float64
+
+	mu     sync.Mutex
+	counts windowCounts
+}
+
+// request counts a request made to the route.
+func (b *retryBudget) request(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.counts.add(now, 1, 0)
+}
+
+// withdraw counts a retry if the budget allows it.
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	requests, retries := b.counts.add(now, 0, 0)
+	if retries+1 > b.ratio*requests+b.reserve {
+		return false
+	}
+
+	b.counts.add(now, 0, 1)
+	return true
+}
+
+// discard drains and closes the response of an attempt that is
+// being retried, so its connection can be reused.
+func discard(res *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+}
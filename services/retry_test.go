@@ -0,0 +1,125 @@
+package services
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "http://" + ln.Addr().String()
+	ln.Close()
+
+	var calls int32
+	var bodies []string
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "dead.test", Upstreams: []Upstream{{URL: dead}, {URL: good.URL}}, Retry: &RetryPolicy{
+			Attempts: 2,
+			Backoff:  Duration(time.Millisecond),
+		}},
+		{Host: "flaky.test", Target: flaky.URL, Retry: &RetryPolicy{
+			Statuses: []int{http.StatusServiceUnavailable},
+			Backoff:  Duration(time.Millisecond),
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	send := func(method, host, body string) int {
+		req := httptest.NewRequest(method, "http://"+host+"/", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 4; i++ {
+		if code := send(http.MethodGet, "dead.test", ""); code != http.StatusOK {
+			t.Errorf("expected GET to be retried on the other upstream, received %d", code)
+		}
+	}
+
+	failed := 0
+	for i := 0; i < 4; i++ {
+		if send(http.MethodPost, "dead.test", "") == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("expected POSTs to the dead upstream not to be retried, %d of 4 failed", failed)
+	}
+
+	if code := send(http.MethodPut, "flaky.test", "payload"); code != http.StatusOK {
+		t.Errorf("expected a 503 to be retried, received %d", code)
+	}
+	if len(bodies) != 2 || bodies[0] != "payload" || bodies[1] != "payload" {
+		t.Errorf("expected the body to be sent with every attempt, received %q", bodies)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{ratio: 0.5, reserve: 1, counts: windowCounts{window: retryBudgetWindow}}
+	now := time.Unix(0, 0)
+
+	for i := 0; i < 4; i++ {
+		b.request(now)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !b.withdraw(now) {
+			t.Fatalf("expected retry %d to be within budget", i)
+		}
+	}
+	if b.withdraw(now) {
+		t.Fatal("expected the budget to be exhausted")
+	}
+
+	now = now.Add(2 * retryBudgetWindow)
+	if !b.withdraw(now) {
+		t.Error("expected the reserve to allow a retry once the window passed")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p, err := newRetryPolicy(&RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.cfg.Attempts != defaultRetryAttempts || !p.on["connect"] || !p.methods[http.MethodGet] || p.methods[http.MethodPost] {
+		t.Errorf("unexpected defaults: %+v", p.cfg)
+	}
+
+	for _, invalid := range []*RetryPolicy{
+		{Attempts: -1},
+		{On: []string{"everything"}},
+		{Statuses: []int{42}},
+		{Budget: 2},
+	} {
+		if _, err := newRetryPolicy(invalid); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
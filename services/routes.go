@@ -0,0 +1,662 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Route maps requests for a host, and optionally a path pattern,
+// to a target or a pool of upstreams.
+//
+// Path patterns are made of "/" separated segments. A segment starting
+// with ":" captures that segment as a named parameter and a trailing
+// "/*" matches any remaining path. When several routes match a request
+// the one with the longest pattern wins.
+type Route struct {
+	Host   string `json:"host"`
+	Path   string `json:"path,omitempty"`
+	Target string `json:"target,omitempty"`
+
+	// Upstreams lists the servers requests are balanced over. Target,
+	// when set, is treated as one more upstream with weight 1.
+	Upstreams   []Upstream      `json:"upstreams,omitempty"`
+	Balancer    *BalancerConfig `json:"balancer,omitempty"`
+	HealthCheck *HealthCheck    `json:"healthCheck,omitempty"`
+
+	// StripPrefix removes the part of the request path matched by
+	// Path before forwarding to the target.
+	StripPrefix bool `json:"stripPrefix,omitempty"`
+
+	// Rewrite replaces the request path before forwarding. Parameters
+	// captured by Path can be referenced as ":name" and the remainder
+	// matched by a trailing "*" as "*".
+	Rewrite string `json:"rewrite,omitempty"`
+
+	// PreserveHost sends the client's Host header to the upstream
+	// instead of the upstream's own host.
+	PreserveHost bool `json:"preserveHost,omitempty"`
+
+	// TLS marks the route as served over TLS, optionally with a
+	// certificate selected by SNI for its host.
+	TLS *RouteTLS `json:"tls,omitempty"`
+
+	// UpstreamTLS configures connections to https upstreams.
+	UpstreamTLS *UpstreamTLS `json:"upstreamTLS,omitempty"`
+
+	// RateLimit limits the requests each client can make.
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+
+	// Access restricts the client addresses the route is served to.
+	Access *AccessList `json:"access,omitempty"`
+
+	// CircuitBreaker and OutlierDetection stop sending
+	// requests to upstreams that keep failing.
+	CircuitBreaker   *CircuitBreaker   `json:"circuitBreaker,omitempty"`
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"`
+
+	// Retry sends failed requests again.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	// Timeouts bound how long the route waits on its upstreams.
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+
+	// Upgrades limits connections switched to WebSocket or
+	// another protocol.
+	Upgrades *Upgrades `json:"upgrades,omitempty"`
+
+	// Protocol is spoken to the upstreams: "http1" (the default),
+	// "h2" for HTTP/2 over TLS or "h2c" for HTTP/2 with prior
+	// knowledge over plain TCP, as gRPC servers expect.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Routes is the list of configured routes. It decodes from either a
+// list of Route objects or, for backwards compatibility, an object
+// mapping "host" or "host/path" to a target URL.
+type Routes []Route
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Routes) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var routes []Route
+		if err := json.Unmarshal(data, &routes); err != nil {
+			return err
+		}
+		*r = routes
+		return nil
+	}
+
+	var targets map[string]string
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return err
+	}
+
+	routes := make([]Route, 0, len(targets))
+	for key, target := range targets {
+		route := Route{Host: key, Target: target}
+		if i := strings.Index(key, "/"); i >= 0 {
+			route.Host, route.Path = key[:i], key[i:]
+		}
+		routes = append(routes, route)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].key() < routes[j].key()
+	})
+	*r = routes
+
+	return nil
+}
+
+// key identifies a route within the table.
+func (r Route) key() string {
+	return r.Host + cleanPattern(r.Path)
+}
+
+// Validate checks that the route has a host, a valid path pattern,
+// upstreams that are absolute HTTP(S) URLs and a known balancer.
+func (r Route) Validate() error {
+	_, err := compileRoute(r)
+	return err
+}
+
+// route is a compiled Route.
+type route struct {
+	Route
+	key      string
+	pattern  *pattern
+	backends []*Backend
+	balancer Balancer
+	proxy    *httputil.ReverseProxy
+	health   *healthChecker
+	cert     *certFile
+	client   *clientAuth
+	limiter  *rateLimiter
+	access   *accessList
+	outlier  *outlierDetector
+	retry    *retryPolicy
+	timeouts Timeouts
+	upgrades Upgrades
+	inFlight int64
+
+	// upgrading counts the upgrade requests in progress, which last
+	// as long as their connections, and upgraded those switched over.
+	upgrading, upgraded int64
+
+	onUpstreamChange func(route string, b *Backend, event, reason string)
+
+	// logger records requests whose upstream failed.
+	logger Logger
+}
+
+func compileRoute(r Route) (*route, error) {
+	if r.Host == "" {
+		return nil, errors.New("route host must not be empty")
+	}
+
+	p, err := compilePattern(r.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid path for %s", r.key())
+	}
+
+	backends, err := newBackends(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkProtocol(r, backends); err != nil {
+		return nil, errors.Wrapf(err, "invalid protocol for %s", r.key())
+	}
+
+	balancer, err := newBalancer(r.Balancer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid balancer for %s", r.key())
+	}
+
+	compiled := &route{
+		Route:    r,
+		key:      r.key(),
+		pattern:  p,
+		backends: backends,
+		balancer: balancer,
+	}
+	tlsConfig, err := newUpstreamTLSConfig(r.UpstreamTLS)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid upstream TLS for %s", r.key())
+	}
+	compiled.timeouts, err = newTimeouts(r.Timeouts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timeouts for %s", r.key())
+	}
+	compiled.upgrades, err = newUpgrades(r.Upgrades)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid upgrade limits for %s", r.key())
+	}
+	compiled.proxy = newProxy(compiled, tlsConfig)
+
+	if r.TLS != nil && (r.TLS.CertFile != "" || r.TLS.KeyFile != "") {
+		compiled.cert, err = loadCertFile(KeyPair{CertFile: r.TLS.CertFile, KeyFile: r.TLS.KeyFile})
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid certificate for %s", r.key())
+		}
+
+		if err := compiled.cert.get().Leaf.VerifyHostname(hostname(r.Host)); err != nil {
+			return nil, errors.Wrapf(err, "invalid certificate for %s", r.key())
+		}
+	}
+
+	compiled.client, err = newClientAuth(r.TLS)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid client authentication for %s", r.key())
+	}
+
+	compiled.access, err = newAccessList(r.Access)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid access list for %s", r.key())
+	}
+
+	compiled.limiter, err = newRateLimiter(compiled.key, r.RateLimit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid rate limit for %s", r.key())
+	}
+
+	if r.CircuitBreaker != nil {
+		cfg := *r.CircuitBreaker
+		if err := cfg.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid circuit breaker for %s", r.key())
+		}
+
+		for _, b := range backends {
+			b.circuit = newCircuitBreaker(cfg)
+		}
+	}
+
+	if r.OutlierDetection != nil {
+		cfg := *r.OutlierDetection
+		if err := cfg.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid outlier detection for %s", r.key())
+		}
+
+		compiled.outlier = newOutlierDetector(cfg)
+	}
+
+	compiled.retry, err = newRetryPolicy(r.Retry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid retry policy for %s", r.key())
+	}
+
+	if r.HealthCheck != nil {
+		compiled.health, err = newHealthChecker(compiled.key, *r.HealthCheck, compiled.transport().base)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid health check for %s", r.key())
+		}
+	}
+
+	return compiled, nil
+}
+
+func (r *route) transport() *upstreamTransport {
+	return r.proxy.Transport.(*upstreamTransport)
+}
+
+// pick chooses a healthy, enabled backend whose circuit breaker
+// admits the request and that hasn't been ejected, preferring one
+// that hasn't been tried yet. The request is counted against the
+// backend until it's released.
+func (r *route) pick(req *http.Request, tried ...*Backend) *Backend {
+	now := time.Now()
+	candidates := r.candidates(now, tried)
+	if len(candidates) == 0 && len(tried) > 0 {
+		candidates = r.candidates(now, nil)
+	}
+
+	// another request can take the last slot of a breaker
+	// between checking and picking it, so try the rest.
+	for len(candidates) > 0 {
+		b := r.balancer.Pick(req, candidates)
+		if r.acquire(b, now) {
+			return b
+		}
+
+		for i, c := range candidates {
+			if c == b {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// candidates returns the backends available to take a
+// request, leaving out those in exclude.
+func (r *route) candidates(now time.Time, exclude []*Backend) []*Backend {
+	candidates := make([]*Backend, 0, len(r.backends))
+next:
+	for _, b := range r.backends {
+		for _, e := range exclude {
+			if b == e {
+				continue next
+			}
+		}
+
+		if b.Healthy() && b.State() == UpstreamEnabled && r.available(b, now) {
+			candidates = append(candidates, b)
+		}
+	}
+
+	return candidates
+}
+
+// start begins health checking the route's backends, if configured,
+// and reports circuit breaker and ejection changes to onUpstreamChange.
+func (r *route) start(
+	onHealthChange func(route string, b *Backend, healthy bool, err error),
+	onUpstreamChange func(route string, b *Backend, event, reason string),
+) {
+	r.onUpstreamChange = onUpstreamChange
+	if r.health == nil {
+		return
+	}
+
+	r.health.onChange = onHealthChange
+	r.health.start(r.backends)
+}
+
+// close stops health checks and releases the idle
+// upstream connections held by the route.
+func (r *route) close() {
+	if r.health != nil {
+		r.health.close()
+	}
+
+	r.transport().CloseIdleConnections()
+}
+
+// match is the result of routing a request.
+type match struct {
+	*route
+	params map[string]string
+	// prefix is the part of the request path matched by the pattern,
+	// rest is whatever a trailing wildcard consumed.
+	prefix string
+	rest   string
+}
+
+// forwardPath returns the path that should be sent to the target.
+func (m *match) forwardPath(original string) string {
+	switch {
+	case m.Rewrite != "":
+		segments := strings.Split(strings.Trim(m.Rewrite, "/"), "/")
+		for i, seg := range segments {
+			switch {
+			case seg == "*":
+				segments[i] = strings.Trim(m.rest, "/")
+			case strings.HasPrefix(seg, ":"):
+				segments[i] = m.params[seg[1:]]
+			}
+		}
+		rewritten := path.Clean("/" + strings.Join(segments, "/"))
+		if strings.HasSuffix(original, "/") && rewritten != "/" {
+			rewritten += "/"
+		}
+		return rewritten
+	case m.StripPrefix:
+		stripped := strings.TrimPrefix(original, m.prefix)
+		if !strings.HasPrefix(stripped, "/") {
+			stripped = "/" + stripped
+		}
+		return stripped
+	default:
+		return original
+	}
+}
+
+type paramsKey struct{}
+
+// RouteParams returns the path parameters captured by the route that
+// matched the request, if any.
+func RouteParams(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+// routeTable is an immutable snapshot of the configured routes. The
+// handler swaps whole tables on reload so a request always sees one
+// consistent set of routes from start to finish.
+type routeTable struct {
+	hosts map[string][]*route
+	keys  map[string]*route
+	// certs holds route certificates by host name.
+	certs map[string]*certFile
+	// clientAuth holds the host names with a route
+	// requiring client certificates.
+	clientAuth map[string]bool
+}
+
+// newRouteTable compiles the routes into a table. Routes that are
+// unchanged from prev are carried over as-is so they keep their
+// proxies, connections and balancer state.
+func newRouteTable(routes Routes, prev *routeTable) (*routeTable, error) {
+	t := &routeTable{
+		hosts:      map[string][]*route{},
+		keys:       map[string]*route{},
+		certs:      map[string]*certFile{},
+		clientAuth: map[string]bool{},
+	}
+
+	for _, r := range routes {
+		key := r.key()
+		if _, ok := t.keys[key]; ok {
+			return nil, errors.Errorf("duplicate route: %s", key)
+		}
+
+		compiled, ok := prev.unchanged(r)
+		if !ok {
+			var err error
+			compiled, err = compileRoute(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		t.keys[key] = compiled
+		t.hosts[r.Host] = append(t.hosts[r.Host], compiled)
+
+		if compiled.cert != nil {
+			name := hostname(r.Host)
+			if other, ok := t.certs[name]; ok && other.pair.CertFile != compiled.cert.pair.CertFile {
+				return nil, errors.Errorf("conflicting certificates for %s", name)
+			}
+			t.certs[name] = compiled.cert
+		}
+
+		if compiled.client != nil {
+			t.clientAuth[hostname(r.Host)] = true
+		}
+	}
+
+	for _, routes := range t.hosts {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return routes[i].pattern.before(routes[j].pattern)
+		})
+	}
+
+	return t, nil
+}
+
+// unchanged returns the compiled route from this table
+// if it has exactly the same configuration as r.
+func (t *routeTable) unchanged(r Route) (*route, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	existing, ok := t.keys[r.key()]
+	if !ok || !reflect.DeepEqual(existing.Route, r) {
+		return nil, false
+	}
+
+	return existing, true
+}
+
+// lookup finds the most specific route for the host and path.
+func (t *routeTable) lookup(host, reqPath string) (*match, bool) {
+	for _, r := range t.hosts[host] {
+		params, prefix, rest, ok := r.pattern.match(reqPath)
+		if !ok {
+			continue
+		}
+
+		return &match{
+			route:  r,
+			params: params,
+			prefix: prefix,
+			rest:   rest,
+		}, true
+	}
+
+	return nil, false
+}
+
+// hostnames returns the DNS names routes are served for, without
+// ports, skipping the catch-all host and IP addresses.
+func (t *routeTable) hostnames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for host := range t.hosts {
+		host = hostname(host)
+		if host == "" || strings.Contains(host, "*") || net.ParseIP(host) != nil || seen[host] {
+			continue
+		}
+
+		seen[host] = true
+		names = append(names, host)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// sortedKeys returns the route keys in order.
+func (t *routeTable) sortedKeys() []string {
+	keys := make([]string, 0, len(t.keys))
+	for key := range t.keys {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// changed returns the keys of routes that differ between the
+// two tables, including routes that were added or removed.
+func (t *routeTable) changed(next *routeTable) []string {
+	var keys []string
+	for key, r := range t.keys {
+		if other, ok := next.keys[key]; !ok || !reflect.DeepEqual(r.Route, other.Route) {
+			keys = append(keys, key)
+		}
+	}
+
+	for key := range next.keys {
+		if _, ok := t.keys[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// pattern is a compiled path pattern.
+type pattern struct {
+	segments []string
+	wildcard bool
+	literals int
+}
+
+// cleanPath removes dot-segments and repeated slashes from a request
+// path, keeping any trailing slash, so that every route is matched
+// and forwarded on the path the upstream will resolve.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+func cleanPattern(p string) string {
+	if p == "" || p == "/" || p == "/*" {
+		return "/*"
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	return p
+}
+
+func compilePattern(raw string) (*pattern, error) {
+	raw = cleanPattern(raw)
+
+	p := &pattern{}
+	trimmed := strings.Trim(raw, "/")
+	if trimmed == "" {
+		return p, nil
+	}
+
+	segments := strings.Split(trimmed, "/")
+	for i, seg := range segments {
+		switch {
+		case seg == "*":
+			if i != len(segments)-1 {
+				return nil, errors.Errorf("wildcard must be the last segment: %s", raw)
+			}
+			p.wildcard = true
+			segments = segments[:i]
+		case seg == "" || seg == ":":
+			return nil, errors.Errorf("empty path segment: %s", raw)
+		case strings.HasPrefix(seg, ":"):
+		default:
+			p.literals++
+		}
+	}
+
+	p.segments = segments
+
+	return p, nil
+}
+
+// before reports whether p should be tried before other: longer
+// patterns win, then exact matches over wildcards, then literal
+// segments over parameters.
+func (p *pattern) before(other *pattern) bool {
+	if len(p.segments) != len(other.segments) {
+		return len(p.segments) > len(other.segments)
+	}
+
+	if p.wildcard != other.wildcard {
+		return !p.wildcard
+	}
+
+	return p.literals > other.literals
+}
+
+func (p *pattern) match(reqPath string) (map[string]string, string, string, bool) {
+	trimmed := strings.Trim(reqPath, "/")
+	var parts []string
+	if trimmed != "" {
+		parts = strings.Split(trimmed, "/")
+	}
+
+	if len(parts) < len(p.segments) || (!p.wildcard && len(parts) != len(p.segments)) {
+		return nil, "", "", false
+	}
+
+	var params map[string]string
+	for i, seg := range p.segments {
+		if strings.HasPrefix(seg, ":") {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:]] = parts[i]
+			continue
+		}
+
+		if seg != parts[i] {
+			return nil, "", "", false
+		}
+	}
+
+	prefix := ""
+	if len(p.segments) > 0 {
+		prefix = "/" + strings.Join(parts[:len(p.segments)], "/")
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(reqPath, "/"), strings.TrimPrefix(prefix, "/"))
+
+	return params, prefix, rest, true
+}
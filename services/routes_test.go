@@ -0,0 +1,148 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRoutesUnmarshal(t *testing.T) {
+	var cfg Config
+	data := `{"targets": {"b.local": "http://b", "a.local/v1/*": "http://a"}}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("failed to decode map form: %v", err)
+	}
+
+	expected := Routes{
+		{Host: "a.local", Path: "/v1/*", Target: "http://a"},
+		{Host: "b.local", Target: "http://b"},
+	}
+	if len(cfg.Targets) != len(expected) {
+		t.Fatalf("expected %d routes, received %d", len(expected), len(cfg.Targets))
+	}
+
+	for i, r := range expected {
+		if !reflect.DeepEqual(cfg.Targets[i], r) {
+			t.Errorf("expected route %d to be %+v, received %+v", i, r, cfg.Targets[i])
+		}
+	}
+
+	data = `{"targets": [{"host": "a.local", "path": "/static/*", "target": "http://s", "stripPrefix": true}]}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("failed to decode list form: %v", err)
+	}
+
+	if len(cfg.Targets) != 1 || !cfg.Targets[0].StripPrefix {
+		t.Errorf("expected a single stripped route, received %+v", cfg.Targets)
+	}
+}
+
+func TestRouteLookup(t *testing.T) {
+	table, err := newRouteTable(Routes{
+		{Host: "api.local", Target: "http://root"},
+		{Host: "api.local", Path: "/v1/*", Target: "http://v1"},
+		{Host: "api.local", Path: "/v1/users/*", Target: "http://users", StripPrefix: true},
+		{Host: "api.local", Path: "/v1/users/:id", Target: "http://user"},
+		{Host: "api.local", Path: "/v1/users/me", Target: "http://me"},
+		{Host: "api.local", Path: "/v2/:name/*", Target: "http://v2", Rewrite: "/svc/:name/*"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		target  string
+		forward string
+		params  map[string]string
+	}{
+		{path: "/", target: "root", forward: "/"},
+		{path: "/other", target: "root", forward: "/other"},
+		{path: "/v1", target: "v1", forward: "/v1"},
+		{path: "/v1/things", target: "v1", forward: "/v1/things"},
+		{path: "/v1/users/me", target: "me", forward: "/v1/users/me"},
+		{path: "/v1/users/42", target: "user", forward: "/v1/users/42", params: map[string]string{"id": "42"}},
+		{path: "/v1/users/42/posts", target: "users", forward: "/42/posts"},
+		{path: "/v2/orders/1/items/", target: "v2", forward: "/svc/orders/1/items/", params: map[string]string{"name": "orders"}},
+	}
+
+	for _, tc := range tests {
+		m, ok := table.lookup("api.local", tc.path)
+		if !ok {
+			t.Errorf("%s: expected a route", tc.path)
+			continue
+		}
+
+		if host := m.backends[0].URL.Host; host != tc.target {
+			t.Errorf("%s: expected target %s, received %s", tc.path, tc.target, host)
+		}
+
+		if forward := m.forwardPath(tc.path); forward != tc.forward {
+			t.Errorf("%s: expected to forward %s, received %s", tc.path, tc.forward, forward)
+		}
+
+		for k, v := range tc.params {
+			if m.params[k] != v {
+				t.Errorf("%s: expected param %s=%s, received %s", tc.path, k, v, m.params[k])
+			}
+		}
+	}
+
+	if _, ok := table.lookup("other.local", "/"); ok {
+		t.Error("expected no route for unknown host")
+	}
+
+	if _, err := newRouteTable(Routes{
+		{Host: "a", Target: "http://a"},
+		{Host: "a", Path: "/*", Target: "http://b"},
+	}, nil); err == nil {
+		t.Error("expected duplicate routes to be rejected")
+	}
+}
+
+func TestDotSegmentsCantReachOtherRoutes(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.Path
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "app.test", Target: upstream.URL},
+		{Host: "app.test", Path: "/admin/*", Target: upstream.URL, Access: &AccessList{Allow: []string{"10.0.0.0/8"}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	tests := []struct {
+		path    string
+		status  int
+		forward string
+	}{
+		{"/admin/x", http.StatusForbidden, ""},
+		{"/public/../admin/x", http.StatusForbidden, ""},
+		{"/public/%2e%2e/admin/x", http.StatusForbidden, ""},
+		{"//admin/x", http.StatusForbidden, ""},
+		{"/public/./docs/", http.StatusOK, "/public/docs/"},
+		{"/public/../../etc", http.StatusOK, "/etc"},
+	}
+
+	for _, tt := range tests {
+		forwarded = ""
+		req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		req.URL, _ = url.ParseRequestURI(tt.path)
+		req.RequestURI = tt.path
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status || forwarded != tt.forward {
+			t.Errorf("%s: expected %d forwarding %q, received %d forwarding %q", tt.path, tt.status, tt.forward, rec.Code, forwarded)
+		}
+	}
+}
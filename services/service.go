@@ -1,8 +1,9 @@
 package services
 
 import (
-	"crypto/tls"
+	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"cloud.google.com/go/logging"
@@ -20,39 +21,225 @@ type TLS struct {
 
 	CertFile string `json:"cert_file,omitempty"`
 	KeyFile  string `json:"key_file,omitempty"`
+
+	// Certificates are served, by SNI, for the names they cover.
+	// The certificate above is the default for any other name.
+	Certificates []KeyPair `json:"certificates,omitempty"`
+
+	// ACME obtains certificates for every route host automatically.
+	// A static certificate, if any, is served for other names.
+	ACME *ACMEConfig `json:"acme,omitempty"`
+
+	// ListenAddress is the HTTPS listener's address, ":443" by default.
+	ListenAddress string `json:"listen_address,omitempty"`
+
+	// Policy names a preset of versions, cipher suites and curves,
+	// "intermediate" by default. The settings below override it.
+	Policy       string   `json:"policy,omitempty"`
+	MinVersion   string   `json:"min_version,omitempty"`
+	MaxVersion   string   `json:"max_version,omitempty"`
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+	Curves       []string `json:"curves,omitempty"`
+
+	// ALPN lists the protocols offered, "h2" and "http/1.1" by default.
+	ALPN []string `json:"alpn,omitempty"`
 }
 
 func Start(cfg *Config) error {
 
-	se, err := stackdriver.NewExporter(stackdriver.Options{
-		ProjectID: cfg.ProjectID,
-	})
+	// traces and metrics are only exported to Stackdriver when
+	// there is a Google Cloud project to send them to.
+	if cfg.ProjectID != "" {
+		se, err := stackdriver.NewExporter(stackdriver.Options{
+			ProjectID: cfg.ProjectID,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to create Stackdriver exporter")
+		}
+
+		trace.RegisterExporter(se)
+		view.RegisterExporter(se)
+		defer se.Flush()
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = NewTextLogger(os.Stdout)
+	}
+	defer cfg.Logger.Flush()
+
+	tracing := cfg.Tracing
+	if tracing == nil {
+		tracing = &TracingConfig{}
+	}
+
+	sampler, err := newSampler(tracing.Sampler)
 	if err != nil {
-		return errors.Wrap(err, "failed to create Stackdriver exporter")
+		return errors.Wrap(err, "invalid trace sampler")
 	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: sampler})
 
-	trace.RegisterExporter(se)
-	view.RegisterExporter(se)
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	format, err := newPropagation(tracing.Propagation)
+	if err != nil {
+		return errors.Wrap(err, "invalid trace propagation")
+	}
+
+	if tracing.OTLP != nil {
+		exporter, err := newOTLPExporter(*tracing.OTLP, cfg.Logger)
+		if err != nil {
+			return errors.Wrap(err, "failed to create OTLP exporter")
+		}
+		exporter.start()
+		defer exporter.close()
+
+		trace.RegisterExporter(exporter)
+	}
+
+	table, err := newRouteTable(cfg.Targets, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to build route table")
+	}
+
+	accessLog, err := newAccessLogger(cfg.AccessLog, cfg.Logger)
+	if err != nil {
+		return err
+	}
 
 	h := &handler{
-		targets:   cfg.Targets,
 		logger:    cfg.Logger,
+		accessLog: accessLog,
+		format:    format,
 		projectID: cfg.ProjectID,
+
+		readinessPath: cfg.ReadinessPath,
 	}
+
+	h.trusted, err = parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return errors.Wrap(err, "invalid trusted proxies")
+	}
+	h.proxyHeader = http.CanonicalHeaderKey(cfg.TrustedProxyHeader)
+
+	h.access, err = newAccessList(cfg.Access)
+	if err != nil {
+		return err
+	}
+	h.setTable(table)
+	h.runtime.base, h.runtime.targets = cfg, cfg.Targets
 	http.Handle("/", h)
 
-	censusHandler := &ochttp.Handler{Handler: h}
+	if cfg.TLS != nil {
+		h.certs, err = newCertStore(cfg.TLS, h.table)
+		if err != nil {
+			return err
+		}
+
+		if cfg.TLS.ACME != nil {
+			h.certs.acme, err = newACMEManager(*cfg.TLS.ACME, h.certs.acmeHosts, h.logger)
+			if err != nil {
+				return errors.Wrap(err, "failed to set up ACME")
+			}
+			h.certs.acme.start()
+			defer h.certs.acme.close()
+		}
+
+		if err := h.certs.check(table); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go h.watch(cfg, done)
+
+	censusHandler := &ochttp.Handler{Handler: h, Propagation: format}
 	if err := view.Register(ochttp.DefaultServerViews...); err != nil {
 		return errors.Wrap(err, "failed to register ochttp.DefaultServerViews")
 	}
 
+	if err := view.Register(Views...); err != nil {
+		return errors.Wrap(err, "failed to register butler views")
+	}
+
+	upgrades, err := newUpgrader()
+	if err != nil {
+		return err
+	}
+
+	// the metrics and admin listeners are closed as soon as an
+	// upgraded process takes over, rather than drained.
+	var secondary []*http.Server
+	if cfg.Metrics != nil {
+		ln, err := upgrades.listen(cfg.Metrics.ListenAddress)
+		if err != nil {
+			return err
+		}
+
+		metrics := newMetricsServer(cfg.Metrics, cfg.ReadinessPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ready(w)
+		}))
+		secondary = append(secondary, metrics)
+		go func() {
+			err := serveMetrics(metrics, ln, cfg.Metrics, h.logger)
+			if err == http.ErrServerClosed {
+				return
+			}
+			h.logger.Log(logging.Entry{
+				Timestamp: time.Now().UTC(),
+				Severity:  logging.Error,
+				Payload:   errors.Wrap(err, "fell out of serving metrics").Error(),
+			})
+		}()
+	}
+
+	if cfg.Admin != nil {
+		admin, err := newAdminServer(cfg.Admin, h)
+		if err != nil {
+			return err
+		}
+
+		ln, err := upgrades.listen(cfg.Admin.ListenAddress)
+		if err != nil {
+			return err
+		}
+		secondary = append(secondary, admin)
+
+		h.logger.Log(logging.Entry{
+			Timestamp: time.Now().UTC(),
+			Severity:  logging.Info,
+			Labels: map[string]string{
+				"listenAddress": cfg.Admin.ListenAddress,
+			},
+			Payload: "Serving admin API",
+		})
+
+		go func() {
+			var err error
+			if cfg.Admin.CertFile != "" {
+				err = admin.ServeTLS(ln, cfg.Admin.CertFile, cfg.Admin.KeyFile)
+			} else {
+				err = admin.Serve(ln)
+			}
+			if err == http.ErrServerClosed {
+				return
+			}
+			h.logger.Log(logging.Entry{
+				Timestamp: time.Now().UTC(),
+				Severity:  logging.Error,
+				Payload:   errors.Wrap(err, "fell out of serving the admin API").Error(),
+			})
+		}()
+	}
+
+	errorLog := log.New(&serverErrorLog{logger: h.logger}, "", 0)
+
 	if cfg.TLS == nil {
 
 		server := &http.Server{
-			Addr:    cfg.ListenAddress,
-			Handler: censusHandler,
+			Addr:     cfg.ListenAddress,
+			Handler:  censusHandler,
+			ErrorLog: errorLog,
 		}
+		cfg.Timeouts.apply(server)
 
 		h.logger.Log(logging.Entry{
 			Timestamp: time.Now().UTC(),
@@ -63,70 +250,73 @@ func Start(cfg *Config) error {
 			Payload: "Serving traffic via proxy",
 		})
 
-		return errors.Wrap(
-			server.ListenAndServe(),
-			"fell out of listening for HTTP traffic",
-		)
+		ln, err := upgrades.listen(cfg.ListenAddress)
+		if err != nil {
+			return err
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- errors.Wrap(
+				server.Serve(ln),
+				"fell out of listening for HTTP traffic",
+			)
+		}()
+
+		return h.run(cfg, upgrades, secondary, errs, server)
 	}
 
 	// tell the handler if it's supposed to
 	// enforce HTTPS usage.
 	h.EnforceSSL = cfg.TLS.Enforce
 
-	var cert tls.Certificate
+	tlsConfig, err := cfg.TLS.serverConfig()
+	if err != nil {
+		return errors.Wrap(err, "invalid TLS configuration")
+	}
+	tlsConfig.GetCertificate = h.certs.GetCertificate
+	tlsConfig.GetConfigForClient = h.certs.configForClient(tlsConfig)
 
-	switch {
-	case cfg.TLS.CertBlock != nil && cfg.TLS.KeyBlock != nil:
-		cert, err = tls.X509KeyPair(cfg.TLS.CertBlock, cfg.TLS.KeyBlock)
-	case cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "":
-		cert, err = tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	plainHandler := http.Handler(censusHandler)
+	if h.certs.acme != nil {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acmeALPNProto)
+		plainHandler = h.certs.acme.HTTPHandler(censusHandler)
 	}
 
-	if err != nil {
-		return errors.Wrap(err, "failed to read TLS certificate")
+	secure := &http.Server{
+		Addr:      cfg.TLS.listenAddress(),
+		Handler:   censusHandler,
+		TLSConfig: tlsConfig,
+		ErrorLog:  errorLog,
 	}
+	unsecure := &http.Server{
+		Addr:     cfg.ListenAddress,
+		Handler:  plainHandler,
+		ErrorLog: errorLog,
+	}
+	cfg.Timeouts.apply(secure)
+	cfg.Timeouts.apply(unsecure)
 
-	tlsConfig := &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
-		Certificates: []tls.Certificate{cert},
+	secureLn, err := upgrades.listen(secure.Addr)
+	if err != nil {
+		return err
+	}
+	unsecureLn, err := upgrades.listen(unsecure.Addr)
+	if err != nil {
+		return err
 	}
 
-	tlsChan := make(chan error)
-	unsecure := make(chan error)
+	errs := make(chan error, 2)
 	go func() {
-		srv := &http.Server{
-			Addr:      ":443",
-			Handler:   censusHandler,
-			TLSConfig: tlsConfig,
-		}
-		tlsChan <- srv.ListenAndServeTLS("", "")
+		errs <- secure.ServeTLS(secureLn, "", "")
 	}()
 
 	go func() {
-		srv := &http.Server{
-			Addr:    cfg.ListenAddress,
-			Handler: censusHandler,
-		}
-
-		unsecure <- errors.Wrap(
-			srv.ListenAndServe(),
+		errs <- errors.Wrap(
+			unsecure.Serve(unsecureLn),
 			"failed to listen for HTTP traffic",
 		)
 	}()
 
-	select {
-	case err := <-tlsChan:
-		return err
-	case err := <-unsecure:
-		return err
-	}
+	return h.run(cfg, upgrades, secondary, errs, secure, unsecure)
 }
@@ -1,7 +1,6 @@
 package services
 
 import (
-	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,8 +10,6 @@ import (
 	"os"
 	"strings"
 	"testing"
-
-	"cloud.google.com/go/logging"
 )
 
 const (
@@ -22,7 +19,7 @@ const (
 var (
 	server    *httptest.Server
 	localhost string
-	logger    *logging.Logger
+	logger    Logger
 )
 
 func TestMain(m *testing.M) {
@@ -38,12 +35,7 @@ func TestMain(m *testing.M) {
 
 	localhost = host.Host
 
-	client, err := logging.NewClient(context.Background(), os.Getenv("PROJECT_ID"))
-	if err != nil {
-		log.Fatalf("failed to create client: %v", err)
-	}
-
-	logger = client.Logger(logName)
+	logger = NewTextLogger(ioutil.Discard)
 
 	os.Exit(m.Run())
 }
@@ -58,19 +50,19 @@ func TestService(t *testing.T) {
 
 		host, err := url.Parse(listenAddr.URL)
 		if err != nil {
-			t.Fatalf("failed to parse httptest server URL: %v", err)
+			t.Errorf("failed to parse httptest server URL: %v", err)
 			return
 		}
 
 		if err := Start(&Config{
 			ProjectID:     os.Getenv("PROJECT_ID"),
 			ListenAddress: host.Host,
-			Targets: map[string]string{
-				"butler-proxy": server.URL,
+			Targets: Routes{
+				{Host: "butler-proxy", Target: server.URL},
 			},
 			Logger: logger,
 		}); err != nil {
-			t.Fatalf("failed to start server: %v", err)
+			t.Errorf("failed to start server: %v", err)
 		}
 	}()
 
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+// connTracker follows connections hijacked from the server, which
+// http.Server.Shutdown neither waits for nor closes.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+
+	// upgrade is set for upgraded connections, whose limits
+	// are enforced by the idle and lifetime timers.
+	upgrade  *upgrade
+	idle     *time.Timer
+	lifetime *time.Timer
+	closing  int32
+
+	// writeMu guards writes to the client and, for WebSockets, the
+	// frames written so far and the close frame waiting to be sent.
+	writeMu   sync.Mutex
+	frames    frameTracker
+	goingAway []byte
+	closeSent bool
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.touch()
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	var n int
+	var err error
+	if c.upgrade != nil && c.upgrade.websocket {
+		n, err = c.writeFrames(p)
+	} else {
+		n, err = c.Conn.Write(p)
+	}
+	c.writeMu.Unlock()
+
+	c.touch()
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mu.Lock()
+		delete(c.tracker.conns, c)
+		c.tracker.mu.Unlock()
+
+		c.closed()
+	})
+
+	return c.Conn.Close()
+}
+
+// track returns conn wrapped so that it is forgotten once closed.
+// Connections upgraded by a route are held to the route's limits.
+func (t *connTracker) track(conn net.Conn, u *upgrade) net.Conn {
+	c := &trackedConn{Conn: conn, tracker: t}
+	if u != nil {
+		c.upgraded(u)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns == nil {
+		t.conns = map[*trackedConn]struct{}{}
+	}
+	t.conns[c] = struct{}{}
+
+	return c
+}
+
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.conns)
+}
+
+// wait returns once every tracked connection has been closed,
+// or with the context's error if that happens first.
+func (t *connTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for t.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (t *connTracker) list() []*trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+// goAway asks WebSocket clients to close their connections.
+func (t *connTracker) goAway() {
+	for _, c := range t.list() {
+		c.goAway(closeGoingAway, "server shutting down")
+	}
+}
+
+// closeAll closes every tracked connection and returns how many there were.
+func (t *connTracker) closeAll() int {
+	conns := t.list()
+	for _, c := range conns {
+		c.Close()
+	}
+
+	return len(conns)
+}
+
+// ready answers readiness probes, failing once draining has begun.
+func (h *handler) ready(w http.ResponseWriter) {
+	if atomic.LoadInt32(&h.draining) != 0 {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// run blocks until a server fails or the process is asked to stop,
+// in which case the servers are drained before it returns. On SIGUSR2
+// the listeners are handed to a new process first, and this one only
+// drains once that process is ready. The secondary servers are closed
+// at that point so that they're only answered by the new process.
+func (h *handler) run(cfg *Config, upgrades *upgrader, secondary []*http.Server, errs <-chan error, servers ...*http.Server) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sig)
+
+	if err := upgrades.ready(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case s := <-sig:
+			if s == syscall.SIGUSR2 {
+				if err := upgrades.upgrade(); err != nil {
+					h.logger.Log(logging.Entry{
+						Timestamp: time.Now().UTC(),
+						Severity:  logging.Error,
+						Payload:   "Upgrade failed: " + err.Error(),
+					})
+					continue
+				}
+
+				for _, srv := range secondary {
+					srv.Close()
+				}
+			}
+
+			h.logger.Log(logging.Entry{
+				Timestamp: time.Now().UTC(),
+				Severity:  logging.Info,
+				Labels: map[string]string{
+					"signal": s.String(),
+				},
+				Payload: "Shutting down",
+			})
+		}
+
+		h.shutdown(cfg.drainDelay(), cfg.drainTimeout(), servers...)
+		return nil
+	}
+}
+
+// shutdown fails readiness and keeps serving for delay, so that load
+// balancers polling the proxy see it fail and stop sending traffic.
+// It then stops the servers accepting connections, sends WebSocket
+// clients a close frame and waits up to timeout for in-flight requests
+// and hijacked connections to finish. Anything still open after that
+// is closed.
+func (h *handler) shutdown(delay, timeout time.Duration, servers ...*http.Server) {
+	atomic.StoreInt32(&h.draining, 1)
+	if delay > 0 {
+		h.logger.Log(logging.Entry{
+			Timestamp: time.Now().UTC(),
+			Severity:  logging.Info,
+			Labels: map[string]string{
+				"drainDelay": delay.String(),
+			},
+			Payload: "Failing readiness before draining",
+		})
+		time.Sleep(delay)
+	}
+
+	h.conns.goAway()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+
+	if err := h.conns.wait(ctx); err == nil && ctx.Err() == nil {
+		h.logger.Log(logging.Entry{
+			Timestamp: time.Now().UTC(),
+			Severity:  logging.Info,
+			Payload:   "Drained connections",
+		})
+		return
+	}
+
+	for _, srv := range servers {
+		srv.Close()
+	}
+	closed := h.conns.closeAll()
+
+	h.logger.Log(logging.Entry{
+		Timestamp: time.Now().UTC(),
+		Severity:  logging.Warning,
+		Labels: map[string]string{
+			"drainTimeout": timeout.String(),
+			"hijacked":     strconv.Itoa(closed),
+		},
+		Payload: "Drain timed out, closing remaining connections",
+	})
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{{Host: "butler.test", Target: upstream.URL}}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger, readinessPath: "/ready"}
+	h.setTable(table)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	probe := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://any.host/ready", nil))
+		return rec.Code
+	}
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("expected readiness to pass, received %d", code)
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Host = "butler.test"
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		result <- string(body)
+	}()
+
+	<-started
+	h.shutdown(0, 5*time.Second, srv.Config)
+
+	if body := <-result; body != "done" {
+		t.Errorf("expected the in-flight request to complete, received %q", body)
+	}
+
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to fail while draining, received %d", code)
+	}
+
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Error("expected new connections to be refused")
+	}
+}
+
+func TestShutdownDelay(t *testing.T) {
+	h := &handler{logger: logger, readinessPath: "/ready"}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		h.shutdown(300*time.Millisecond, time.Second, srv.Config)
+		close(done)
+	}()
+
+	waitFor(t, "draining to start", func() bool {
+		return atomic.LoadInt32(&h.draining) == 1
+	})
+
+	res, err := http.Get(srv.URL + "/ready")
+	if err != nil {
+		t.Fatalf("expected connections to be accepted during the delay: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to fail on the proxy listener, received %d", res.StatusCode)
+	}
+
+	<-done
+	if _, err := http.Get(srv.URL + "/ready"); err == nil {
+		t.Error("expected new connections to be refused after the delay")
+	}
+}
+
+func TestShutdownClosesHijacked(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		brw.Flush()
+		ioutil.ReadAll(conn)
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{{Host: "butler.test", Target: upstream.URL}}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: butler.test\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected protocol switch, received %d", res.StatusCode)
+	}
+
+	if n := h.conns.count(); n != 1 {
+		t.Fatalf("expected the upgraded connection to be tracked, tracking %d", n)
+	}
+
+	start := time.Now()
+	h.shutdown(0, 200*time.Millisecond, srv.Config)
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected shutdown to give up after the drain timeout, took %s", elapsed)
+	}
+
+	if n := h.conns.count(); n != 0 {
+		t.Errorf("expected hijacked connections to be closed, %d remain", n)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the client connection to be closed")
+	}
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Tag keys used by butler's views.
+var (
+	keyRoute, _    = tag.NewKey("route")
+	keyUpstream, _ = tag.NewKey("upstream")
+	keyResult, _   = tag.NewKey("result")
+	keyCode, _     = tag.NewKey("code")
+	keyError, _    = tag.NewKey("error")
+	keyCert, _     = tag.NewKey("certificate")
+)
+
+// latencyBuckets are the histogram bounds, in seconds, for latency views.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Measures recorded by butler.
+var (
+	upstreamHealthy = stats.Int64(
+		"butler/upstream/healthy",
+		"Whether an upstream is passing its health checks (1) or not (0)",
+		stats.UnitDimensionless,
+	)
+	healthChecks = stats.Int64(
+		"butler/upstream/health_checks",
+		"Number of health checks run against an upstream",
+		stats.UnitDimensionless,
+	)
+	requests = stats.Int64(
+		"butler/requests",
+		"Number of requests handled",
+		stats.UnitDimensionless,
+	)
+	requestLatency = stats.Float64(
+		"butler/request_latency",
+		"Time from receiving a request until its response completed",
+		"s",
+	)
+	upstreamLatency = stats.Float64(
+		"butler/upstream/latency",
+		"Time from sending a request upstream until its response headers arrived",
+		"s",
+	)
+	inFlight = stats.Int64(
+		"butler/in_flight",
+		"Number of requests currently being handled",
+		stats.UnitDimensionless,
+	)
+	upstreamErrors = stats.Int64(
+		"butler/upstream/errors",
+		"Number of requests that failed to get a response from an upstream",
+		stats.UnitDimensionless,
+	)
+	upstreamRetries = stats.Int64(
+		"butler/upstream/retries",
+		"Number of failed upstream requests retried or not retried for lack of budget",
+		stats.UnitDimensionless,
+	)
+	upgradesActive = stats.Int64(
+		"butler/upgrades/active",
+		"Number of upgraded connections, such as WebSockets, currently open",
+		stats.UnitDimensionless,
+	)
+	upgradesTotal = stats.Int64(
+		"butler/upgrades/total",
+		"Number of connections upgraded to another protocol",
+		stats.UnitDimensionless,
+	)
+	tlsHandshakeErrors = stats.Int64(
+		"butler/tls/handshake_errors",
+		"Number of failed TLS handshakes with clients",
+		stats.UnitDimensionless,
+	)
+	rateLimited = stats.Int64(
+		"butler/rate_limited",
+		"Number of requests rejected by a rate limit",
+		stats.UnitDimensionless,
+	)
+	circuitState = stats.Int64(
+		"butler/upstream/circuit_state",
+		"State of an upstream's circuit breaker: closed (0), half-open (1) or open (2)",
+		stats.UnitDimensionless,
+	)
+	outlierEjections = stats.Int64(
+		"butler/upstream/ejections",
+		"Number of times an upstream was ejected by outlier detection",
+		stats.UnitDimensionless,
+	)
+	certExpiry = stats.Float64(
+		"butler/tls/certificate_expiry",
+		"Unix time at which a served certificate expires",
+		"s",
+	)
+)
+
+// Views is the set of views butler registers with OpenCensus.
+var Views = []*view.View{
+	{
+		Name:        "butler/upstream/healthy",
+		Description: "Whether an upstream is passing its health checks",
+		Measure:     upstreamHealthy,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "butler/upstream/health_checks",
+		Description: "Count of health checks by route, upstream and result",
+		Measure:     healthChecks,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream, keyResult},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/requests",
+		Description: "Count of requests by route, upstream and status code",
+		Measure:     requests,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream, keyCode},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/request_latency_seconds",
+		Description: "Distribution of total request latency by route",
+		Measure:     requestLatency,
+		TagKeys:     []tag.Key{keyRoute},
+		Aggregation: view.Distribution(latencyBuckets...),
+	},
+	{
+		Name:        "butler/upstream/latency_seconds",
+		Description: "Distribution of upstream latency by route and upstream",
+		Measure:     upstreamLatency,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream},
+		Aggregation: view.Distribution(latencyBuckets...),
+	},
+	{
+		Name:        "butler/in_flight",
+		Description: "Requests currently being handled by route",
+		Measure:     inFlight,
+		TagKeys:     []tag.Key{keyRoute},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "butler/upstream/errors",
+		Description: "Count of upstream errors by route, upstream and type",
+		Measure:     upstreamErrors,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream, keyError},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/upstream/retries",
+		Description: "Count of retries by route and result",
+		Measure:     upstreamRetries,
+		TagKeys:     []tag.Key{keyRoute, keyResult},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/upstream/circuit_state",
+		Description: "State of each upstream's circuit breaker",
+		Measure:     circuitState,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "butler/upstream/ejections",
+		Description: "Count of outlier ejections by route and upstream",
+		Measure:     outlierEjections,
+		TagKeys:     []tag.Key{keyRoute, keyUpstream},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/rate_limited",
+		Description: "Count of requests rejected by a rate limit by route",
+		Measure:     rateLimited,
+		TagKeys:     []tag.Key{keyRoute},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/upgrades/active",
+		Description: "Upgraded connections currently open by route",
+		Measure:     upgradesActive,
+		TagKeys:     []tag.Key{keyRoute},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "butler/upgrades/total",
+		Description: "Count of upgraded connections by route",
+		Measure:     upgradesTotal,
+		TagKeys:     []tag.Key{keyRoute},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/tls/handshake_errors",
+		Description: "Count of failed TLS handshakes",
+		Measure:     tlsHandshakeErrors,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "butler/tls/certificate_expiry_seconds",
+		Description: "Unix time at which each certificate expires",
+		Measure:     certExpiry,
+		TagKeys:     []tag.Key{keyCert},
+		Aggregation: view.LastValue(),
+	},
+}
+
+// record tags the measurements with the given mutators
+// and records them, dropping them if tagging fails.
+func record(ctx context.Context, mutators []tag.Mutator, ms ...stats.Measurement) {
+	ctx, err := tag.New(ctx, mutators...)
+	if err != nil {
+		return
+	}
+
+	stats.Record(ctx, ms...)
+}
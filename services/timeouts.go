@@ -0,0 +1,256 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultConnectTimeout      = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// Kinds of upstream timeouts, as reported in 504 responses.
+const (
+	timeoutConnect        = "connect"
+	timeoutTLSHandshake   = "TLS handshake"
+	timeoutResponseHeader = "response header"
+	timeoutIdle           = "idle"
+	timeoutRequest        = "request"
+)
+
+// Timeouts bound how long a route waits on its upstreams. Connect
+// (default 30s) and TLSHandshake (default 10s) cover establishing a
+// connection, ResponseHeader the wait for the response headers and
+// Idle each wait for more of the response body. Request covers the
+// whole request, retries included. Zero means no limit.
+type Timeouts struct {
+	Connect        Duration `json:"connect,omitempty"`
+	TLSHandshake   Duration `json:"tlsHandshake,omitempty"`
+	ResponseHeader Duration `json:"responseHeader,omitempty"`
+	Idle           Duration `json:"idle,omitempty"`
+	Request        Duration `json:"request,omitempty"`
+}
+
+func newTimeouts(cfg *Timeouts) (Timeouts, error) {
+	t := Timeouts{}
+	if cfg != nil {
+		t = *cfg
+	}
+
+	if t.Connect < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Idle < 0 || t.Request < 0 {
+		return t, errors.New("timeouts must not be negative")
+	}
+
+	if t.Connect == 0 {
+		t.Connect = Duration(defaultConnectTimeout)
+	}
+	if t.TLSHandshake == 0 {
+		t.TLSHandshake = Duration(defaultTLSHandshakeTimeout)
+	}
+
+	return t, nil
+}
+
+// ServerTimeouts bound how long clients may take to send requests
+// and receive responses, and how long idle keep-alive connections
+// are kept. ReadHeader defaults to 10s and Idle to 2m; Read and
+// Write are unlimited unless set.
+type ServerTimeouts struct {
+	ReadHeader Duration `json:"readHeader,omitempty"`
+	Read       Duration `json:"read,omitempty"`
+	Write      Duration `json:"write,omitempty"`
+	Idle       Duration `json:"idle,omitempty"`
+}
+
+// Validate checks that no timeout is negative.
+func (t *ServerTimeouts) Validate() error {
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+
+	return nil
+}
+
+// apply sets the timeouts on a server.
+func (t *ServerTimeouts) apply(srv *http.Server) {
+	cfg := ServerTimeouts{}
+	if t != nil {
+		cfg = *t
+	}
+
+	if cfg.ReadHeader == 0 {
+		cfg.ReadHeader = Duration(defaultReadHeaderTimeout)
+	}
+	if cfg.Idle == 0 {
+		cfg.Idle = Duration(defaultIdleTimeout)
+	}
+
+	srv.ReadHeaderTimeout = time.Duration(cfg.ReadHeader)
+	srv.ReadTimeout = time.Duration(cfg.Read)
+	srv.WriteTimeout = time.Duration(cfg.Write)
+	srv.IdleTimeout = time.Duration(cfg.Idle)
+}
+
+// upstreamTimeout is an upstream request that ran out of time.
+type upstreamTimeout struct {
+	kind string
+	err  error
+}
+
+func (e *upstreamTimeout) Error() string {
+	return fmt.Sprintf("%s timeout: %v", e.kind, e.err)
+}
+
+func (e *upstreamTimeout) Timeout() bool   { return true }
+func (e *upstreamTimeout) Temporary() bool { return true }
+
+// dialer returns a dial function that reports
+// connection timeouts as such.
+func dialer(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() == nil {
+			return nil, &upstreamTimeout{kind: timeoutConnect, err: err}
+		}
+
+		return conn, err
+	}
+}
+
+// timeoutKind returns which timeout, if any, an upstream error is due to.
+func timeoutKind(r *http.Request, err error) string {
+	if t, ok := errors.Cause(err).(*upstreamTimeout); ok {
+		return t.kind
+	}
+
+	if strings.Contains(err.Error(), "TLS handshake timeout") {
+		return timeoutTLSHandshake
+	}
+
+	if r.Context().Err() == context.DeadlineExceeded {
+		return timeoutRequest
+	}
+
+	return ""
+}
+
+// proxyError logs a request whose upstream failed and answers it
+// with a 504 naming the timeout when it timed out and a 502 otherwise.
+// gRPC calls get DEADLINE_EXCEEDED or UNAVAILABLE instead.
+func (r *route) proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	if state := requestFrom(req.Context()); state != nil && r.logger != nil {
+		state.entry.Severity = logging.Error
+		state.entry.Labels["service"] = r.key
+		if state.upstream != "" {
+			state.entry.Labels["upstream"] = state.upstream
+		}
+		state.entry.Payload = "Proxy error: " + err.Error()
+		r.logger.Log(state.entry)
+	}
+
+	kind := timeoutKind(req, err)
+	if isGRPC(req) {
+		if kind == "" {
+			grpcError(w, grpcUnavailable, "upstream unavailable")
+			return
+		}
+		grpcError(w, grpcDeadlineExceeded, kind+" timeout")
+		return
+	}
+
+	if kind == "" {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("%s: %s timeout", http.StatusText(http.StatusGatewayTimeout), kind), http.StatusGatewayTimeout)
+}
+
+// headerTimer cancels an upstream request whose
+// response headers don't arrive in time.
+type headerTimer struct {
+	timer *time.Timer
+	// state is 0 while waiting, 1 once timed
+	// out and 2 once the headers arrived.
+	state int32
+}
+
+func startHeaderTimer(timeout time.Duration, cancel context.CancelFunc) *headerTimer {
+	if timeout <= 0 {
+		return nil
+	}
+
+	t := &headerTimer{}
+	t.timer = time.AfterFunc(timeout, func() {
+		if atomic.CompareAndSwapInt32(&t.state, 0, 1) {
+			cancel()
+		}
+	})
+
+	return t
+}
+
+// stop reports whether the timer fired before it was stopped.
+func (t *headerTimer) stop() bool {
+	if t == nil {
+		return false
+	}
+
+	t.timer.Stop()
+	return !atomic.CompareAndSwapInt32(&t.state, 0, 2)
+}
+
+// idleBody fails reads that wait on the upstream for longer than
+// timeout, canceling the upstream request.
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleBody {
+	b := &idleBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.fired, 1)
+		cancel()
+	})
+	b.timer.Stop()
+
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+
+	if atomic.LoadInt32(&b.fired) == 1 {
+		return n, &upstreamTimeout{kind: timeoutIdle, err: err}
+	}
+
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
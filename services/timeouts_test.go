@@ -0,0 +1,94 @@
+package services
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/body" {
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("second"))
+	}))
+	defer slow.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "header.test", Target: slow.URL, Timeouts: &Timeouts{ResponseHeader: Duration(20 * time.Millisecond)}},
+		{Host: "request.test", Target: slow.URL, Timeouts: &Timeouts{Request: Duration(20 * time.Millisecond)}},
+		{Host: "idle.test", Target: slow.URL, Timeouts: &Timeouts{Idle: Duration(20 * time.Millisecond)}},
+		{Host: "patient.test", Target: slow.URL, Timeouts: &Timeouts{ResponseHeader: Duration(time.Second)}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	var logs bytes.Buffer
+	h := &handler{logger: NewTextLogger(&logs)}
+	h.setTable(table)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"http://header.test/", http.StatusGatewayTimeout, "Gateway Timeout: response header timeout\n"},
+		{"http://request.test/", http.StatusGatewayTimeout, "Gateway Timeout: request timeout\n"},
+		{"http://idle.test/body", http.StatusOK, "first"},
+		{"http://patient.test/", http.StatusOK, "second"},
+	}
+
+	for _, tt := range tests {
+		start := time.Now()
+		rec := get(tt.url)
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("expected %d %q from %s, received %d %q", tt.status, tt.body, tt.url, rec.Code, rec.Body.String())
+		}
+		if tt.status != http.StatusOK && time.Since(start) > 250*time.Millisecond {
+			t.Errorf("expected %s to time out early, took %s", tt.url, time.Since(start))
+		}
+	}
+
+	if !strings.Contains(logs.String(), "Proxy error: response header timeout") || !strings.Contains(logs.String(), `service="header.test`) {
+		t.Errorf("expected upstream failures to be logged with their route, logged %q", logs.String())
+	}
+
+	if _, err := newTimeouts(&Timeouts{Idle: Duration(-time.Second)}); err == nil {
+		t.Error("expected negative timeouts to be rejected")
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	var srv http.Server
+	(*ServerTimeouts)(nil).apply(&srv)
+	if srv.ReadHeaderTimeout != defaultReadHeaderTimeout || srv.IdleTimeout != defaultIdleTimeout || srv.WriteTimeout != 0 {
+		t.Errorf("unexpected defaults: read header %s, idle %s, write %s", srv.ReadHeaderTimeout, srv.IdleTimeout, srv.WriteTimeout)
+	}
+
+	(&ServerTimeouts{Read: Duration(time.Minute), Write: Duration(2 * time.Minute)}).apply(&srv)
+	if srv.ReadTimeout != time.Minute || srv.WriteTimeout != 2*time.Minute {
+		t.Errorf("expected timeouts to be applied, received read %s and write %s", srv.ReadTimeout, srv.WriteTimeout)
+	}
+
+	if err := (&ServerTimeouts{Write: Duration(-time.Second)}).Validate(); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("expected negative timeouts to be rejected, received %v", err)
+	}
+}
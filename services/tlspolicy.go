@@ -0,0 +1,205 @@
+package services
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// Named TLS policies for the HTTPS listener, following the
+// Mozilla server side TLS guidelines.
+const (
+	PolicyModern       = "modern"
+	PolicyIntermediate = "intermediate"
+	PolicyLegacy       = "legacy"
+)
+
+const defaultTLSAddress = ":443"
+
+// tlsVersions maps the version names accepted in
+// configuration to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+type tlsPolicy struct {
+	minVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+var intermediateCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsPolicies = map[string]tlsPolicy{
+	// TLS 1.3 suites aren't configurable, so modern
+	// leaves the cipher suites to crypto/tls.
+	PolicyModern: {
+		minVersion: tls.VersionTLS13,
+		curves:     []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	PolicyIntermediate: {
+		minVersion: tls.VersionTLS12,
+		ciphers:    intermediateCiphers,
+		curves:     []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	PolicyLegacy: {
+		minVersion: tls.VersionTLS10,
+		ciphers: append(append([]uint16{}, intermediateCiphers...),
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		),
+		curves: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+}
+
+func tlsVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, errors.Errorf("unknown TLS version: %s", name)
+	}
+
+	return v, nil
+}
+
+func cipherSuite(name string) (uint16, error) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite.ID, nil
+			}
+		}
+	}
+
+	return 0, errors.Errorf("unknown cipher suite: %s", name)
+}
+
+// listenAddress returns the address the HTTPS listener binds to.
+func (t *TLS) listenAddress() string {
+	if t.ListenAddress == "" {
+		return defaultTLSAddress
+	}
+
+	return t.ListenAddress
+}
+
+// serverConfig returns the listener's TLS config for the configured
+// policy, with any explicitly listed settings taking precedence.
+func (t *TLS) serverConfig() (*tls.Config, error) {
+	name := t.Policy
+	if name == "" {
+		name = PolicyIntermediate
+	}
+
+	policy, ok := tlsPolicies[name]
+	if !ok {
+		return nil, errors.Errorf("unknown TLS policy: %s", name)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:               policy.minVersion,
+		CipherSuites:             policy.ciphers,
+		CurvePreferences:         policy.curves,
+		PreferServerCipherSuites: true,
+		NextProtos:               append([]string{}, t.ALPN...),
+	}
+
+	var err error
+	if t.MinVersion != "" {
+		if cfg.MinVersion, err = tlsVersion(t.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.MaxVersion, err = tlsVersion(t.MaxVersion); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < cfg.MinVersion {
+		return nil, errors.Errorf("TLS max_version %s is below the minimum version", t.MaxVersion)
+	}
+
+	if len(t.CipherSuites) > 0 {
+		cfg.CipherSuites = nil
+		for _, name := range t.CipherSuites {
+			id, err := cipherSuite(name)
+			if err != nil {
+				return nil, err
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	if len(t.Curves) > 0 {
+		cfg.CurvePreferences = nil
+		for _, name := range t.Curves {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return nil, errors.Errorf("unknown curve: %s", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	// net/http refuses to serve HTTP/2 without one of
+	// the cipher suites it requires.
+	if cfg.CipherSuites != nil && offersH2(cfg.NextProtos) && !h2Capable(cfg.CipherSuites) {
+		return nil, errors.New("h2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	}
+
+	return cfg, nil
+}
+
+func offersH2(protos []string) bool {
+	for _, proto := range protos {
+		if proto == "h2" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func h2Capable(ciphers []uint16) bool {
+	for _, id := range ciphers {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+
+	return false
+}
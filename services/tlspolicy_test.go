@@ -0,0 +1,106 @@
+package services
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTLSServerConfig(t *testing.T) {
+	cfg, err := (&TLS{}).serverConfig()
+	if err != nil {
+		t.Fatalf("failed to build default config: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || !reflect.DeepEqual(cfg.CipherSuites, intermediateCiphers) {
+		t.Errorf("expected the intermediate policy by default, received %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.NextProtos, []string{"h2", "http/1.1"}) {
+		t.Errorf("expected h2 and http/1.1 to be offered, received %v", cfg.NextProtos)
+	}
+
+	cfg, err = (&TLS{
+		Policy:       PolicyLegacy,
+		MinVersion:   "1.2",
+		MaxVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"P256"},
+		ALPN:         []string{"http/1.1"},
+	}).serverConfig()
+	if err != nil {
+		t.Fatalf("failed to build config: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("expected versions to be overridden, received %x-%x", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if !reflect.DeepEqual(cfg.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("expected cipher suites to be overridden, received %v", cfg.CipherSuites)
+	}
+	if !reflect.DeepEqual(cfg.CurvePreferences, []tls.CurveID{tls.CurveP256}) {
+		t.Errorf("expected curves to be overridden, received %v", cfg.CurvePreferences)
+	}
+	if !reflect.DeepEqual(cfg.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("expected ALPN to be overridden, received %v", cfg.NextProtos)
+	}
+
+	for _, invalid := range []*TLS{
+		{Policy: "paranoid"},
+		{MinVersion: "2.0"},
+		{Policy: PolicyModern, MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_NULL"}},
+		{Curves: []string{"P224"}},
+		{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+	} {
+		if _, err := invalid.serverConfig(); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestTLSPolicyHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, "server", "policy.test")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := (&TLS{Policy: PolicyModern}).serverConfig()
+	if err != nil {
+		t.Fatalf("failed to build config: %v", err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(maxVersion uint16) error {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: maxVersion},
+		}}
+
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+
+	if err := get(tls.VersionTLS13); err != nil {
+		t.Errorf("expected a TLS 1.3 client to connect: %v", err)
+	}
+
+	if err := get(tls.VersionTLS12); err == nil {
+		t.Error("expected a TLS 1.2 client to be refused by the modern policy")
+	}
+}
@@ -0,0 +1,271 @@
+package services
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"go.opencensus.io/trace/tracestate"
+)
+
+// Propagation formats understood by TracingConfig.Propagation.
+const (
+	PropagationTraceContext = "tracecontext"
+	PropagationB3           = "b3"
+)
+
+// Sampler types understood by SamplerConfig.Type.
+const (
+	SampleAlways      = "always"
+	SampleNever       = "never"
+	SampleRatio       = "ratio"
+	SampleParentBased = "parent_based"
+	SampleRateLimited = "rate_limited"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// TracingConfig configures how traces are sampled, propagated
+// to and from clients and upstreams, and exported.
+type TracingConfig struct {
+	Sampler *SamplerConfig `json:"sampler,omitempty"`
+	// Propagation lists the header formats read from incoming
+	// requests, in order of preference, and written to upstreams.
+	// It defaults to tracecontext and b3.
+	Propagation []string    `json:"propagation,omitempty"`
+	OTLP        *OTLPConfig `json:"otlp,omitempty"`
+}
+
+// SamplerConfig selects the sampler for new traces.
+//
+// ratio samples Ratio of traces by trace ID, rate_limited samples at
+// most PerSecond traces each second and parent_based follows the
+// sampling decision of a remote parent, falling back to Root.
+type SamplerConfig struct {
+	Type      string         `json:"type"`
+	Ratio     float64        `json:"ratio,omitempty"`
+	PerSecond float64        `json:"perSecond,omitempty"`
+	Root      *SamplerConfig `json:"root,omitempty"`
+}
+
+func newSampler(cfg *SamplerConfig) (trace.Sampler, error) {
+	if cfg == nil {
+		return trace.AlwaysSample(), nil
+	}
+
+	switch cfg.Type {
+	case "", SampleAlways:
+		return trace.AlwaysSample(), nil
+	case SampleNever:
+		return trace.NeverSample(), nil
+	case SampleRatio:
+		if cfg.Ratio < 0 || cfg.Ratio > 1 {
+			return nil, errors.Errorf("sampler ratio must be between 0 and 1: %v", cfg.Ratio)
+		}
+		return ratioSampler(cfg.Ratio), nil
+	case SampleRateLimited:
+		if cfg.PerSecond <= 0 {
+			return nil, errors.New("rate_limited sampler requires perSecond")
+		}
+		return rateLimitedSampler(cfg.PerSecond), nil
+	case SampleParentBased:
+		root, err := newSampler(cfg.Root)
+		if err != nil {
+			return nil, err
+		}
+		return parentBasedSampler(root), nil
+	default:
+		return nil, errors.Errorf("unknown sampler: %s", cfg.Type)
+	}
+}
+
+// ratioSampler samples a fraction of traces based only on the
+// trace ID, so every hop using the same ratio agrees.
+func ratioSampler(ratio float64) trace.Sampler {
+	bound := uint64(ratio * (1 << 63))
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		x := binary.BigEndian.Uint64(p.TraceID[0:8]) >> 1
+		return trace.SamplingDecision{Sample: x < bound}
+	}
+}
+
+func parentBasedSampler(root trace.Sampler) trace.Sampler {
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		if p.ParentContext != (trace.SpanContext{}) {
+			return trace.SamplingDecision{Sample: p.ParentContext.IsSampled()}
+		}
+		return root(p)
+	}
+}
+
+// rateLimitedSampler is a token bucket refilled at perSecond
+// tokens a second, holding at most one second's worth.
+func rateLimitedSampler(perSecond float64) trace.Sampler {
+	var mu sync.Mutex
+	tokens := perSecond
+	last := time.Now()
+
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		tokens += now.Sub(last).Seconds() * perSecond
+		if tokens > perSecond {
+			tokens = perSecond
+		}
+		last = now
+
+		if tokens < 1 {
+			return trace.SamplingDecision{Sample: false}
+		}
+
+		tokens--
+		return trace.SamplingDecision{Sample: true}
+	}
+}
+
+func newPropagation(names []string) (propagation.HTTPFormat, error) {
+	if len(names) == 0 {
+		names = []string{PropagationTraceContext, PropagationB3}
+	}
+
+	formats := make(multiFormat, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case PropagationTraceContext:
+			formats = append(formats, traceContextFormat{})
+		case PropagationB3:
+			formats = append(formats, &b3.HTTPFormat{})
+		default:
+			return nil, errors.Errorf("unknown propagation format: %s", name)
+		}
+	}
+
+	return formats, nil
+}
+
+// multiFormat reads the first span context found in a request
+// and writes the span context in every format.
+type multiFormat []propagation.HTTPFormat
+
+func (m multiFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	for _, f := range m {
+		if sc, ok := f.SpanContextFromRequest(req); ok {
+			return sc, true
+		}
+	}
+
+	return trace.SpanContext{}, false
+}
+
+func (m multiFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	for _, f := range m {
+		f.SpanContextToRequest(sc, req)
+	}
+}
+
+// traceContextFormat implements the W3C Trace Context headers.
+type traceContextFormat struct{}
+
+func (traceContextFormat) SpanContextFromRequest(req *http.Request) (trace.SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(req.Header.Get(traceparentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return trace.SpanContext{}, false
+	}
+
+	// version 00 has exactly four fields, later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return trace.SpanContext{}, false
+	}
+
+	var sc trace.SpanContext
+	if !decodeHex(parts[1], sc.TraceID[:]) || sc.TraceID == (trace.TraceID{}) {
+		return trace.SpanContext{}, false
+	}
+
+	if !decodeHex(parts[2], sc.SpanID[:]) || sc.SpanID == (trace.SpanID{}) {
+		return trace.SpanContext{}, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(parts[3], flags[:]) {
+		return trace.SpanContext{}, false
+	}
+	sc.TraceOptions = trace.TraceOptions(flags[0] & 1)
+
+	sc.Tracestate = parseTracestate(req.Header[http.CanonicalHeaderKey(tracestateHeader)])
+
+	return sc, true
+}
+
+func (traceContextFormat) SpanContextToRequest(sc trace.SpanContext, req *http.Request) {
+	req.Header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%02x",
+		hex.EncodeToString(sc.TraceID[:]),
+		hex.EncodeToString(sc.SpanID[:]),
+		byte(sc.TraceOptions)&1,
+	))
+
+	entries := sc.Tracestate.Entries()
+	if len(entries) == 0 {
+		req.Header.Del(tracestateHeader)
+		return
+	}
+
+	pairs := make([]string, len(entries))
+	for i, e := range entries {
+		pairs[i] = e.Key + "=" + e.Value
+	}
+	req.Header.Set(tracestateHeader, strings.Join(pairs, ","))
+}
+
+func decodeHex(s string, dst []byte) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// parseTracestate returns nil when the header is missing or invalid,
+// in which case it is dropped rather than forwarded.
+func parseTracestate(headers []string) *tracestate.Tracestate {
+	var entries []tracestate.Entry
+	for _, h := range headers {
+		for _, member := range strings.Split(h, ",") {
+			member = strings.TrimSpace(member)
+			if member == "" {
+				continue
+			}
+
+			kv := strings.SplitN(member, "=", 2)
+			if len(kv) != 2 {
+				return nil
+			}
+			entries = append(entries, tracestate.Entry{Key: kv[0], Value: kv[1]})
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ts, err := tracestate.New(nil, entries...)
+	if err != nil {
+		return nil
+	}
+
+	return ts
+}
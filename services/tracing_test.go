@@ -0,0 +1,272 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/net/http2"
+)
+
+func TestTraceContextFormat(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", parent)
+	req.Header.Set("tracestate", "congo=t61rcWkgMzE, rojo=00f067aa0ba902b7")
+
+	sc, ok := traceContextFormat{}.SpanContextFromRequest(req)
+	if !ok {
+		t.Fatal("expected traceparent to be parsed")
+	}
+	if !sc.IsSampled() {
+		t.Error("expected span context to be sampled")
+	}
+
+	out := httptest.NewRequest(http.MethodGet, "/", nil)
+	traceContextFormat{}.SpanContextToRequest(sc, out)
+	if got := out.Header.Get("traceparent"); got != parent {
+		t.Errorf("expected traceparent %s, received %s", parent, got)
+	}
+	if got := out.Header.Get("tracestate"); got != "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7" {
+		t.Errorf("unexpected tracestate: %s", got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		req.Header.Set("traceparent", invalid)
+		if _, ok := (traceContextFormat{}).SpanContextFromRequest(req); ok {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestPropagationFallsBackToB3(t *testing.T) {
+	format, err := newPropagation(nil)
+	if err != nil {
+		t.Fatalf("failed to build propagation: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-B3-TraceId", "4bf92f3577b34da6a3ce929d0e0e4736")
+	req.Header.Set("X-B3-SpanId", "00f067aa0ba902b7")
+	req.Header.Set("X-B3-Sampled", "1")
+
+	sc, ok := format.SpanContextFromRequest(req)
+	if !ok {
+		t.Fatal("expected b3 headers to be parsed")
+	}
+
+	out := httptest.NewRequest(http.MethodGet, "/", nil)
+	format.SpanContextToRequest(sc, out)
+	if got := out.Header.Get("traceparent"); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("unexpected traceparent: %s", got)
+	}
+	if got := out.Header.Get("X-B3-TraceId"); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected X-B3-TraceId: %s", got)
+	}
+
+	if _, err := newPropagation([]string{"jaeger"}); err == nil {
+		t.Error("expected unknown propagation format to be rejected")
+	}
+}
+
+func TestSamplers(t *testing.T) {
+	var low, high trace.TraceID
+	high[0] = 0xff
+
+	half, err := newSampler(&SamplerConfig{Type: SampleRatio, Ratio: 0.5})
+	if err != nil {
+		t.Fatalf("failed to build sampler: %v", err)
+	}
+	if !half(trace.SamplingParameters{TraceID: low}).Sample {
+		t.Error("expected low trace ID to be sampled")
+	}
+	if half(trace.SamplingParameters{TraceID: high}).Sample {
+		t.Error("expected high trace ID not to be sampled")
+	}
+
+	parentBased, err := newSampler(&SamplerConfig{
+		Type: SampleParentBased,
+		Root: &SamplerConfig{Type: SampleNever},
+	})
+	if err != nil {
+		t.Fatalf("failed to build sampler: %v", err)
+	}
+	sampled := trace.SpanContext{TraceID: high, SpanID: trace.SpanID{1}, TraceOptions: 1}
+	if !parentBased(trace.SamplingParameters{ParentContext: sampled}).Sample {
+		t.Error("expected sampled parent to be followed")
+	}
+	if parentBased(trace.SamplingParameters{TraceID: low}).Sample {
+		t.Error("expected root sampler to be used without a parent")
+	}
+
+	limited, err := newSampler(&SamplerConfig{Type: SampleRateLimited, PerSecond: 2})
+	if err != nil {
+		t.Fatalf("failed to build sampler: %v", err)
+	}
+	var count int
+	for i := 0; i < 10; i++ {
+		if limited(trace.SamplingParameters{}).Sample {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Errorf("expected 2 traces to be sampled, received %d", count)
+	}
+
+	for _, invalid := range []*SamplerConfig{
+		{Type: SampleRatio, Ratio: 2},
+		{Type: SampleRateLimited},
+		{Type: "sometimes"},
+	} {
+		if _, err := newSampler(invalid); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestHandlerContinuesTrace(t *testing.T) {
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "tracing-test", Target: upstream.URL},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	req := httptest.NewRequest(http.MethodGet, "http://tracing-test/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	parent := <-received
+	if !strings.HasPrefix(parent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Errorf("expected upstream to continue the trace, received %q", parent)
+	}
+	if strings.Contains(parent, "00f067aa0ba902b7") {
+		t.Errorf("expected upstream to receive a new span ID, received %q", parent)
+	}
+}
+
+func testSpan() *trace.SpanData {
+	return &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID:      trace.TraceID{0x4b, 0xf9, 0x2f, 0x35},
+			SpanID:       trace.SpanID{0x00, 0xf0, 0x67, 0xaa},
+			TraceOptions: 1,
+		},
+		Name:       "butler.upstream",
+		SpanKind:   trace.SpanKindClient,
+		StartTime:  time.Now().Add(-time.Second),
+		EndTime:    time.Now(),
+		Attributes: map[string]interface{}{"http.status_code": int64(200)},
+	}
+}
+
+func TestOTLPHTTPExport(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Errorf("unexpected content type: %s", ct)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("unexpected authorization: %s", auth)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{
+		Endpoint: collector.URL,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to create exporter: %v", err)
+	}
+
+	span := testSpan()
+	e.ExportSpan(span)
+	e.Flush()
+
+	body := <-bodies
+	for _, expected := range [][]byte{span.TraceID[:], span.SpanID[:], []byte(span.Name), []byte("service.name")} {
+		if !bytes.Contains(body, expected) {
+			t.Errorf("expected export to contain %q", expected)
+		}
+	}
+}
+
+func TestOTLPGRPCExport(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2, received %s", r.Proto)
+		}
+		if r.URL.Path != otlpGRPCMethod {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/grpc" {
+			t.Errorf("unexpected content type: %s", ct)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	collector.EnableHTTP2 = true
+	collector.StartTLS()
+	defer collector.Close()
+
+	e, err := newOTLPExporter(OTLPConfig{
+		Endpoint: collector.URL,
+		Protocol: OTLPGRPC,
+	}, logger)
+	if err != nil {
+		t.Fatalf("failed to create exporter: %v", err)
+	}
+	e.client.Transport = &http2.Transport{
+		TLSClientConfig: collector.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+
+	span := testSpan()
+	if err := e.export([]*trace.SpanData{span}); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	body := <-bodies
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		t.Fatalf("expected a length-prefixed gRPC message, received %x", body)
+	}
+	if !bytes.Contains(body, []byte(span.Name)) {
+		t.Errorf("expected export to contain %q", span.Name)
+	}
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The listening sockets handed to an upgraded process are passed as
+// extra files, starting at fd 3 in the order of envListeners, followed
+// by the pipe the new process reports readiness on.
+const (
+	envListeners = "BUTLER_LISTENERS"
+	envReadyFD   = "BUTLER_READY_FD"
+
+	upgradeTimeout = time.Minute
+)
+
+// upgrader hands the process's listening sockets to a new binary
+// so that it can take over without the ports closing in between.
+type upgrader struct {
+	exe  string
+	args []string
+
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners map[string]*net.TCPListener
+	order     []string
+	readyFile *os.File
+}
+
+// newUpgrader picks up any listeners passed on by a parent process.
+func newUpgrader() (*upgrader, error) {
+	u := &upgrader{
+		args:      os.Args[1:],
+		inherited: map[string]*os.File{},
+		listeners: map[string]*net.TCPListener{},
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to locate executable")
+	}
+	u.exe = exe
+
+	if names := os.Getenv(envListeners); names != "" {
+		for i, addr := range strings.Split(names, ",") {
+			u.inherited[addr] = os.NewFile(uintptr(3+i), "listener:"+addr)
+		}
+	}
+
+	if fd := os.Getenv(envReadyFD); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, errors.Errorf("invalid %s: %s", envReadyFD, fd)
+		}
+		u.readyFile = os.NewFile(uintptr(n), "ready")
+	}
+
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReadyFD)
+
+	return u, nil
+}
+
+// listen returns the listener inherited for addr or opens a new one.
+func (u *upgrader) listen(addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if l, ok := u.listeners[addr]; ok {
+		return l, nil
+	}
+
+	var ln net.Listener
+	if f, ok := u.inherited[addr]; ok {
+		delete(u.inherited, addr)
+
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to inherit listener for %s", addr)
+		}
+	} else {
+		listenAddr := addr
+		if listenAddr == "" {
+			listenAddr = ":http"
+		}
+
+		var err error
+		ln, err = net.Listen("tcp", listenAddr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to listen on %s", listenAddr)
+		}
+	}
+
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, errors.Errorf("listener for %s is not TCP", addr)
+	}
+
+	u.listeners[addr] = tcp
+	u.order = append(u.order, addr)
+
+	return tcp, nil
+}
+
+// ready tells the parent process, if any, that this one is serving
+// so the parent can start draining. Inherited listeners the current
+// configuration no longer uses are closed.
+func (u *upgrader) ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for addr, f := range u.inherited {
+		f.Close()
+		delete(u.inherited, addr)
+	}
+
+	if u.readyFile == nil {
+		return nil
+	}
+
+	_, err := u.readyFile.Write([]byte{1})
+	u.readyFile.Close()
+	u.readyFile = nil
+
+	return errors.Wrap(err, "failed to report readiness")
+}
+
+// upgrade starts the current executable with this process's listeners
+// and returns once it reports ready. The new process is killed if it
+// doesn't do so within upgradeTimeout.
+func (u *upgrader) upgrade() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, addr := range u.order {
+		f, err := u.listeners[addr].File()
+		if err != nil {
+			return errors.Wrapf(err, "failed to pass on listener for %s", addr)
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "failed to create readiness pipe")
+	}
+	defer r.Close()
+
+	cmd := exec.Command(u.exe, u.args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(u.order, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to start new process")
+	}
+
+	// the pipe reads EOF without a byte if the new process
+	// exits before reporting ready.
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := r.Read(b); n == 1 {
+			ready <- nil
+			return
+		}
+		ready <- errors.New("new process exited before reporting ready")
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.Errorf("new process wasn't ready within %s", upgradeTimeout)
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+
+	// the new process outlives this one, so it's released
+	// rather than waited on.
+	return cmd.Process.Release()
+}
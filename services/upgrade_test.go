@@ -0,0 +1,112 @@
+package services
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+const envUpgradeHelper = "BUTLER_UPGRADE_HELPER"
+
+// TestUpgradeHelper is the new process started by TestUpgrade. It
+// serves one request on the listener it inherits and then exits.
+func TestUpgradeHelper(t *testing.T) {
+	addr := os.Getenv(envUpgradeHelper)
+	if addr == "" {
+		t.Skip("only run as the process started by TestUpgrade")
+	}
+
+	u, err := newUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := u.listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan struct{})
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("child"))
+		close(served)
+	}))
+
+	if err := u.ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-served:
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(10 * time.Second):
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	u, err := newUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.args = []string{"-test.run=^TestUpgradeHelper$"}
+
+	ln, err := u.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("parent"))
+	})}
+	go srv.Serve(ln)
+
+	url := "http://" + ln.Addr().String()
+	get := func() string {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	if body := get(); body != "parent" {
+		t.Fatalf("expected the parent to serve, received %q", body)
+	}
+
+	os.Setenv(envUpgradeHelper, "127.0.0.1:0")
+	defer os.Unsetenv(envUpgradeHelper)
+
+	if err := u.upgrade(); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	// the port stays open: once the parent stops accepting,
+	// the new process picks up the next connection.
+	srv.Close()
+	if body := get(); body != "child" {
+		t.Errorf("expected the new process to serve, received %q", body)
+	}
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	u, err := newUpgrader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.exe, u.args = "true", nil
+
+	if _, err := u.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.upgrade(); err == nil {
+		t.Error("expected a process that exits without reporting ready to fail the upgrade")
+	}
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// UpstreamTLS configures how a route connects to HTTPS upstreams.
+// Upstream certificates are verified against the system roots
+// unless CAFile or InsecureSkipVerify say otherwise.
+type UpstreamTLS struct {
+	// CAFile is a PEM bundle trusted instead of the system roots.
+	CAFile string `json:"caFile,omitempty"`
+	// ServerName is sent in SNI and verified instead of the upstream host.
+	ServerName string `json:"serverName,omitempty"`
+	// CertFile and KeyFile are presented to upstreams requiring mTLS.
+	CertFile   string `json:"certFile,omitempty"`
+	KeyFile    string `json:"keyFile,omitempty"`
+	MinVersion string `json:"minVersion,omitempty"`
+	// InsecureSkipVerify disables certificate verification entirely.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// newUpstreamTLSConfig returns the client TLS config for a route.
+func newUpstreamTLSConfig(cfg *UpstreamTLS) (*tls.Config, error) {
+	if cfg == nil {
+		return &tls.Config{}, nil
+	}
+
+	minVersion, err := tlsVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read upstream CA")
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read upstream client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
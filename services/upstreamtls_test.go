@@ -0,0 +1,89 @@
+package services
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "butler-upstream-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mtls" && len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	upstream.TLS = &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		MaxVersion: tls.VersionTLS12,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caFile := filepath.Join(dir, "upstream.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeCertificate(t, dir, "client", "butler.test")
+
+	tests := []struct {
+		name     string
+		path     string
+		cfg      *UpstreamTLS
+		expected int
+	}{
+		{name: "verified by default", cfg: nil, expected: http.StatusBadGateway},
+		{name: "custom CA", cfg: &UpstreamTLS{CAFile: caFile}, expected: http.StatusOK},
+		{name: "server name mismatch", cfg: &UpstreamTLS{CAFile: caFile, ServerName: "other.test"}, expected: http.StatusBadGateway},
+		{name: "server name override", cfg: &UpstreamTLS{CAFile: caFile, ServerName: "example.com"}, expected: http.StatusOK},
+		{name: "insecure", cfg: &UpstreamTLS{InsecureSkipVerify: true}, expected: http.StatusOK},
+		{name: "minimum version", cfg: &UpstreamTLS{CAFile: caFile, MinVersion: "1.3"}, expected: http.StatusBadGateway},
+		{name: "without client certificate", path: "/mtls", cfg: &UpstreamTLS{CAFile: caFile}, expected: http.StatusUnauthorized},
+		{name: "client certificate", path: "/mtls", cfg: &UpstreamTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := newRouteTable(Routes{
+				{Host: "butler.test", Target: upstream.URL, UpstreamTLS: tt.cfg},
+			}, nil)
+			if err != nil {
+				t.Fatalf("failed to build route table: %v", err)
+			}
+
+			h := &handler{logger: logger}
+			h.setTable(table)
+
+			req := httptest.NewRequest(http.MethodGet, "http://butler.test"+tt.path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expected {
+				t.Errorf("expected %d, received %d", tt.expected, rec.Code)
+			}
+		})
+	}
+
+	for _, cfg := range []*UpstreamTLS{
+		{MinVersion: "1.4"},
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: keyFile},
+		{CertFile: certFile},
+	} {
+		if _, err := newUpstreamTLSConfig(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
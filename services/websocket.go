@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/pkg/errors"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"golang.org/x/net/http/httpguts"
+)
+
+// WebSocket close codes sent to clients.
+const (
+	closeNormal    = 1000
+	closeGoingAway = 1001
+)
+
+// closeFrameTimeout bounds how long writing a close frame may block.
+const closeFrameTimeout = time.Second
+
+// Upgrades limits the connections a route upgrades to another
+// protocol, such as WebSocket. Connections are closed once no data
+// has flowed either way for IdleTimeout or once they're MaxLifetime
+// old, and no more than MaxConnections are open at once. Zero means
+// no limit.
+type Upgrades struct {
+	IdleTimeout    Duration `json:"idleTimeout,omitempty"`
+	MaxLifetime    Duration `json:"maxLifetime,omitempty"`
+	MaxConnections int64    `json:"maxConnections,omitempty"`
+}
+
+func newUpgrades(cfg *Upgrades) (Upgrades, error) {
+	if cfg == nil {
+		return Upgrades{}, nil
+	}
+
+	if cfg.IdleTimeout < 0 || cfg.MaxLifetime < 0 || cfg.MaxConnections < 0 {
+		return Upgrades{}, errors.New("upgrade limits must not be negative")
+	}
+
+	return *cfg, nil
+}
+
+// upgrade describes a connection being upgraded, so that
+// the connection can be tracked once it's hijacked.
+type upgrade struct {
+	route     string
+	cfg       Upgrades
+	websocket bool
+	active    *int64
+}
+
+// isUpgrade reports whether the request asks to switch protocols.
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// startUpgrade counts an upgrade request against the route's limit and
+// reports whether it may proceed, rejecting it otherwise. done must be
+// called once the request, and the upgraded connection, have finished.
+func (h *handler) startUpgrade(r *request, m *route) (done func(), ok bool) {
+	n := atomic.AddInt64(&m.upgrading, 1)
+	done = func() {
+		atomic.AddInt64(&m.upgrading, -1)
+	}
+
+	if m.upgrades.MaxConnections > 0 && n > m.upgrades.MaxConnections {
+		done()
+
+		r.span.SetStatus(trace.Status{Code: trace.StatusCodeResourceExhausted, Message: "too many upgraded connections"})
+		r.entry.Severity = logging.Warning
+		r.entry.Labels["service"] = m.key
+		r.entry.Payload = "Rejected upgrade: too many upgraded connections"
+		h.logger.Log(r.entry)
+
+		http.Error(r.response, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	r.recorder.upgrade = &upgrade{
+		route:     m.key,
+		cfg:       m.upgrades,
+		websocket: strings.EqualFold(r.request.Header.Get("Upgrade"), "websocket"),
+		active:    &m.upgraded,
+	}
+
+	return done, true
+}
+
+// upgraded starts enforcing the limits of an upgraded connection and
+// counts it in the metrics.
+func (c *trackedConn) upgraded(u *upgrade) {
+	c.upgrade = u
+
+	if idle := time.Duration(u.cfg.IdleTimeout); idle > 0 {
+		c.idle = time.AfterFunc(idle, func() {
+			c.goAway(closeNormal, "idle timeout")
+			c.Close()
+		})
+	}
+
+	if lifetime := time.Duration(u.cfg.MaxLifetime); lifetime > 0 {
+		c.lifetime = time.AfterFunc(lifetime, func() {
+			c.goAway(closeGoingAway, "maximum lifetime reached")
+			c.Close()
+		})
+	}
+
+	mutators := []tag.Mutator{tag.Upsert(keyRoute, u.route)}
+	record(context.Background(), mutators, upgradesTotal.M(1))
+	record(context.Background(), mutators, upgradesActive.M(atomic.AddInt64(u.active, 1)))
+}
+
+// touch pushes back the idle timeout after data has flowed.
+func (c *trackedConn) touch() {
+	if c.idle != nil {
+		c.idle.Reset(time.Duration(c.upgrade.cfg.IdleTimeout))
+	}
+}
+
+// closed stops enforcing the limits of an upgraded connection.
+func (c *trackedConn) closed() {
+	if c.upgrade == nil {
+		return
+	}
+
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	if c.lifetime != nil {
+		c.lifetime.Stop()
+	}
+
+	record(context.Background(), []tag.Mutator{
+		tag.Upsert(keyRoute, c.upgrade.route),
+	}, upgradesActive.M(atomic.AddInt64(c.upgrade.active, -1)))
+}
+
+// errGoingAway stops the upstream's data being forwarded to
+// a WebSocket client once it has been sent a close frame.
+var errGoingAway = errors.New("websocket close frame sent")
+
+// goAway sends a WebSocket close frame to the client, once, so it can
+// close the connection cleanly. The frame is only sent between the
+// upstream's frames: when one is being forwarded, it's sent as soon as
+// that frame is complete. Nothing more is forwarded to the client
+// after it, so the proxy tears the connection down.
+func (c *trackedConn) goAway(code uint16, reason string) {
+	if c.upgrade == nil || !c.upgrade.websocket || !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.goingAway = closeFrame(code, reason)
+	if c.frames.boundary() {
+		c.sendClose()
+	}
+}
+
+// sendClose writes the pending close frame. writeMu must be held.
+func (c *trackedConn) sendClose() {
+	c.closeSent = true
+
+	c.Conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+	c.Conn.Write(c.goingAway)
+	c.Conn.SetWriteDeadline(time.Time{})
+}
+
+// writeFrames forwards the upstream's frames to a WebSocket client,
+// stopping at the end of the frame in progress once the client is to
+// be sent a close frame. writeMu must be held.
+func (c *trackedConn) writeFrames(p []byte) (int, error) {
+	if c.closeSent {
+		return 0, errGoingAway
+	}
+
+	if c.goingAway == nil {
+		c.frames.consume(p, false)
+		return c.Conn.Write(p)
+	}
+
+	n, err := c.Conn.Write(p[:c.frames.consume(p, true)])
+	if err != nil {
+		return n, err
+	}
+
+	if c.frames.boundary() {
+		c.sendClose()
+		return n, errGoingAway
+	}
+
+	return n, nil
+}
+
+// frameTracker follows the frames of a WebSocket stream
+// to tell where one frame ends and the next begins.
+type frameTracker struct {
+	header    []byte
+	remaining uint64
+}
+
+// boundary reports whether the stream is between frames.
+func (f *frameTracker) boundary() bool {
+	return f.remaining == 0 && len(f.header) == 0
+}
+
+// consume reads p and returns how many of its bytes were read, which
+// is all of them unless stop is set, in which case reading stops at
+// the first frame boundary.
+func (f *frameTracker) consume(p []byte, stop bool) int {
+	i := 0
+	for i < len(p) {
+		if stop && f.boundary() {
+			return i
+		}
+
+		if f.remaining > 0 {
+			n := uint64(len(p) - i)
+			if n > f.remaining {
+				n = f.remaining
+			}
+			i += int(n)
+			f.remaining -= n
+			continue
+		}
+
+		f.header = append(f.header, p[i])
+		i++
+		if size := frameHeaderSize(f.header); size > 0 && len(f.header) == size {
+			f.remaining = framePayloadSize(f.header)
+			f.header = f.header[:0]
+		}
+	}
+
+	return i
+}
+
+// frameHeaderSize returns the size of the frame header starting with
+// header, or 0 until enough of it has been read to tell.
+func frameHeaderSize(header []byte) int {
+	if len(header) < 2 {
+		return 0
+	}
+
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		// masking key
+		size += 4
+	}
+
+	return size
+}
+
+// framePayloadSize returns the payload length in a complete frame header.
+func framePayloadSize(header []byte) uint64 {
+	switch n := header[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(n)
+	}
+}
+
+// closeFrame builds an unmasked WebSocket close frame.
+func closeFrame(code uint16, reason string) []byte {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason...)
+
+	return append([]byte{0x88, byte(len(payload))}, payload...)
+}
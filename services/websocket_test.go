@@ -0,0 +1,221 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoUpgrade upgrades every request to WebSocket and echoes what it reads.
+func echoUpgrade(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// dialUpgrade opens an upgraded connection to host through srv.
+func dialUpgrade(t *testing.T, srv *httptest.Server, host string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v", err)
+	}
+
+	return conn, r, res.StatusCode
+}
+
+// readClose reads a close frame and returns its status code.
+func readClose(t *testing.T, conn net.Conn, r *bufio.Reader) uint16 {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("expected a close frame: %v", err)
+	}
+	if header[0] != 0x88 {
+		t.Fatalf("expected a close frame, received opcode %x", header[0])
+	}
+
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("failed to read close frame: %v", err)
+	}
+
+	return binary.BigEndian.Uint16(payload)
+}
+
+func TestUpgradeLimits(t *testing.T) {
+	upstream := echoUpgrade(t)
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{
+		{Host: "chat.test", Target: upstream.URL, Upgrades: &Upgrades{MaxConnections: 1, IdleTimeout: Duration(100 * time.Millisecond)}},
+		{Host: "short.test", Target: upstream.URL, Upgrades: &Upgrades{MaxLifetime: Duration(100 * time.Millisecond)}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, r, status := dialUpgrade(t, srv, "chat.test")
+	defer conn.Close()
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected protocol switch, received %d", status)
+	}
+
+	// traffic keeps the connection from going idle.
+	ping := []byte{0x81, 0x04, 'p', 'i', 'n', 'g'}
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		conn.Write(ping)
+		echo := make([]byte, len(ping))
+		if _, err := io.ReadFull(r, echo); err != nil || !bytes.Equal(echo, ping) {
+			t.Fatalf("expected the upstream to echo, received %q: %v", echo, err)
+		}
+	}
+
+	second, _, status := dialUpgrade(t, srv, "chat.test")
+	second.Close()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected the connection limit to reject a second upgrade, received %d", status)
+	}
+
+	if code := readClose(t, conn, r); code != closeNormal {
+		t.Errorf("expected an idle connection to be closed normally, received %d", code)
+	}
+
+	route, _ := h.table().lookup("chat.test", "/")
+	waitFor(t, "the connection to be released", func() bool {
+		return atomic.LoadInt64(&route.upgrading) == 0 && atomic.LoadInt64(&route.upgraded) == 0
+	})
+
+	short, r, _ := dialUpgrade(t, srv, "short.test")
+	defer short.Close()
+	start := time.Now()
+	if code := readClose(t, short, r); code != closeGoingAway {
+		t.Errorf("expected an old connection to be told to go away, received %d", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the connection to be closed after its lifetime, took %s", elapsed)
+	}
+}
+
+func TestShutdownClosesWebSockets(t *testing.T) {
+	upstream := echoUpgrade(t)
+	defer upstream.Close()
+
+	table, err := newRouteTable(Routes{{Host: "chat.test", Target: upstream.URL}}, nil)
+	if err != nil {
+		t.Fatalf("failed to build route table: %v", err)
+	}
+
+	h := &handler{logger: logger}
+	h.setTable(table)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, r, _ := dialUpgrade(t, srv, "chat.test")
+	defer conn.Close()
+
+	go h.shutdown(0, 200*time.Millisecond, srv.Config)
+
+	if code := readClose(t, conn, r); code != closeGoingAway {
+		t.Errorf("expected clients to be told the server is going away, received %d", code)
+	}
+
+	waitFor(t, "the connection to be closed", func() bool {
+		return h.conns.count() == 0
+	})
+}
+
+func TestCloseFrameBetweenFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var active int64
+	conn := (&connTracker{}).track(server, &upgrade{route: "chat.test", websocket: true, active: &active}).(*trackedConn)
+	defer conn.Close()
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		received <- data
+	}()
+
+	// the close frame waits for the frame being forwarded to end.
+	frame := append([]byte{0x81, 0x0a}, "helloworld"...)
+	if _, err := conn.Write(frame[:7]); err != nil {
+		t.Fatal(err)
+	}
+	conn.goAway(closeGoingAway, "bye")
+
+	rest := append(append([]byte{}, frame[7:]...), 0x81, 0x01, 'x')
+	n, err := conn.Write(rest)
+	if n != len(frame)-7 || err != errGoingAway {
+		t.Errorf("expected forwarding to stop after the frame in progress, wrote %d: %v", n, err)
+	}
+	if _, err := conn.Write([]byte{0x81, 0x01, 'y'}); err != errGoingAway {
+		t.Errorf("expected nothing to be forwarded after the close frame, received %v", err)
+	}
+	conn.Close()
+
+	expected := append(append([]byte{}, frame...), closeFrame(closeGoingAway, "bye")...)
+	if data := <-received; !bytes.Equal(data, expected) {
+		t.Errorf("expected the frame then the close frame, received %x", data)
+	}
+}
+
+func TestFrameTracker(t *testing.T) {
+	long := append([]byte{0x82, 126, 0x01, 0x00}, make([]byte, 256)...)
+	masked := []byte{0x81, 0x82, 1, 2, 3, 4, 'h', 'i'}
+	stream := append(append(append([]byte{}, long...), masked...), 0x89, 0x00)
+
+	// fed a byte at a time, frames end where their lengths say.
+	var f frameTracker
+	var boundaries []int
+	for i := range stream {
+		f.consume(stream[i:i+1], false)
+		if f.boundary() {
+			boundaries = append(boundaries, i+1)
+		}
+	}
+	if len(boundaries) != 3 || boundaries[0] != len(long) || boundaries[1] != len(long)+len(masked) || boundaries[2] != len(stream) {
+		t.Errorf("expected frames to end at %d, %d and %d, found %v", len(long), len(long)+len(masked), len(stream), boundaries)
+	}
+
+	// stopping reads no further than the end of the frame in progress.
+	var g frameTracker
+	g.consume(stream[:5], false)
+	if n := g.consume(stream[5:], true); n != len(long)-5 || !g.boundary() {
+		t.Errorf("expected to stop at the end of the first frame, read %d", n)
+	}
+
+}